@@ -0,0 +1,162 @@
+package negronicache
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	defaultSketchWidth = 4096
+	sketchDepth        = 4
+	// sketchMax caps the counters of the sketch, as in TinyLFU
+	sketchMax = 15
+)
+
+// AdmissionPolicy decides whether a response is stored in the cache, e.g.
+// to keep responses requested only once from evicting popular ones
+type AdmissionPolicy interface {
+	// Record notes a cacheable request for the key
+	Record(key string)
+	// Admit reports whether a response for the key should be stored
+	Admit(key string) bool
+}
+
+// Evicter is implemented by caches reporting the entry they evict next
+type Evicter interface {
+	// Victim returns the key of the entry evicted next, if storing another
+	// entry would evict one
+	Victim() (string, bool)
+}
+
+type admitAll struct{}
+
+func (admitAll) Record(key string)     {}
+func (admitAll) Admit(key string) bool { return true }
+
+// AdmitAll returns a policy storing every cacheable response
+func AdmitAll() AdmissionPolicy {
+	return admitAll{}
+}
+
+// sketch is a count-min sketch estimating the request frequency of keys,
+// whose counters are halved periodically so that old requests fade out
+type sketch struct {
+	mu        sync.Mutex
+	width     uint32
+	counters  [sketchDepth][]uint8
+	additions int
+}
+
+func newSketch(width int) *sketch {
+	if width <= 0 {
+		width = defaultSketchWidth
+	}
+	s := &sketch{width: uint32(width)}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the counter of the key in every row
+func (s *sketch) indexes(key string) [sketchDepth]uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	var idx [sketchDepth]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) % s.width
+	}
+	return idx
+}
+
+func (s *sketch) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, j := range s.indexes(key) {
+		if s.counters[i][j] < sketchMax {
+			s.counters[i][j]++
+		}
+	}
+
+	if s.additions++; s.additions >= 10*int(s.width) {
+		s.additions = 0
+		for i := range s.counters {
+			for j := range s.counters[i] {
+				s.counters[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (s *sketch) estimate(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	min := uint8(sketchMax)
+	for i, j := range s.indexes(key) {
+		if c := s.counters[i][j]; c < min {
+			min = c
+		}
+	}
+	return int(min)
+}
+
+// admitAfter stores responses for keys requested at least n times
+type admitAfter struct {
+	n      int
+	sketch *sketch
+}
+
+// NewAdmitAfter returns a policy storing responses for keys requested at
+// least n times recently, counted by a sketch of width counters per row,
+// 4096 if zero. n is capped to 15.
+func NewAdmitAfter(n, width int) AdmissionPolicy {
+	if n > sketchMax {
+		n = sketchMax
+	}
+	return &admitAfter{n: n, sketch: newSketch(width)}
+}
+
+func (p *admitAfter) Record(key string) {
+	p.sketch.add(key)
+}
+
+func (p *admitAfter) Admit(key string) bool {
+	return p.sketch.estimate(key) >= p.n
+}
+
+// tinyLFU stores a response only if its key is requested more often than
+// the key of the entry it would evict
+type tinyLFU struct {
+	cache  Evicter
+	sketch *sketch
+}
+
+// NewTinyLFU returns a TinyLFU policy for a cache, usually a BoundedCache,
+// comparing the request frequency of a key with that of the entry the cache
+// would evict to store it. Responses are always stored while the cache
+// isn't full, or if it isn't an Evicter.
+func NewTinyLFU(c Cache, width int) AdmissionPolicy {
+	p := &tinyLFU{sketch: newSketch(width)}
+	p.cache, _ = c.(Evicter)
+	return p
+}
+
+func (p *tinyLFU) Record(key string) {
+	p.sketch.add(key)
+}
+
+func (p *tinyLFU) Admit(key string) bool {
+	if p.cache == nil {
+		return true
+	}
+	victim, ok := p.cache.Victim()
+	if !ok || victim == key {
+		return true
+	}
+	return p.sketch.estimate(key) > p.sketch.estimate(victim)
+}
@@ -0,0 +1,76 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketch(t *testing.T) {
+	s := newSketch(64)
+	for i := 0; i < 5; i++ {
+		s.add("a")
+	}
+	s.add("b")
+	assert.True(t, s.estimate("a") >= 5)
+	assert.True(t, s.estimate("b") >= 1)
+	assert.Equal(t, 0, s.estimate("c"))
+
+	// counters are halved every 10 * width additions
+	for i := s.additions; i < 10*64; i++ {
+		s.add("d")
+	}
+	assert.True(t, s.estimate("a") <= 3)
+}
+
+func TestAdmitAfter(t *testing.T) {
+	p := NewAdmitAfter(2, 0)
+	assert.False(t, p.Admit("a"))
+	p.Record("a")
+	assert.False(t, p.Admit("a"))
+	p.Record("a")
+	assert.True(t, p.Admit("a"))
+	assert.True(t, AdmitAll().Admit("a"))
+}
+
+func TestTinyLFU(t *testing.T) {
+	c := NewBoundedMemoryCache(BoundedOptions{MaxEntries: 1})
+	p := NewTinyLFU(c, 0)
+
+	assert.True(t, p.Admit("GET:http://a.com/hot"), "the cache isn't full")
+	storeBytes(t, c, "GET:http://a.com/hot", "hot")
+	for i := 0; i < 3; i++ {
+		p.Record("GET:http://a.com/hot")
+	}
+
+	p.Record("GET:http://a.com/cold")
+	assert.False(t, p.Admit("GET:http://a.com/cold"))
+	for i := 0; i < 3; i++ {
+		p.Record("GET:http://a.com/cold")
+	}
+	assert.True(t, p.Admit("GET:http://a.com/cold"))
+
+	assert.True(t, NewTinyLFU(NewMemoryCache(), 0).Admit("GET:http://a.com/cold"))
+}
+
+func TestMiddleware_Admission(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	mw.Admission = NewAdmitAfter(2, 0)
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "body")
+	}))
+
+	var results []string
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/a", nil))
+		Writes.Wait()
+		results = append(results, rec.Header().Get(CacheHeader))
+	}
+	assert.Equal(t, []string{"SKIP", "SKIP", "HIT"}, results)
+	assert.Equal(t, int64(1), mw.CacheStats().Bypasses[BypassAdmission])
+}
@@ -0,0 +1,456 @@
+// Package boltcache provides a negroni-cache Cache backed by an embedded
+// bbolt database, keeping every entry in a single file on a single node.
+package boltcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	cah "github.com/trumanw/negroni-cache"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// entriesBucket maps keys to entries encoded in the v2 format
+	entriesBucket = []byte("entries")
+	// metaBucket maps keys to their keyMeta
+	metaBucket = []byte("meta")
+	// tagsBucket holds a nested bucket per tag, listing the tagged keys
+	tagsBucket = []byte("tags")
+)
+
+// keyMeta is the metadata kept for a key besides its entry
+type keyMeta struct {
+	// Stale is when the entry was invalidated, zero if it wasn't
+	Stale time.Time `json:"stale,omitempty"`
+	// Variants lists the keys stored alongside the entry
+	Variants []string `json:"variants,omitempty"`
+	// Tags lists the tags the key is indexed under
+	Tags []string `json:"tags,omitempty"`
+	// Expires is when the freshness lifetime of the entry ends, for private
+	// and shared caches alike
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Options configures a bbolt Cache
+type Options struct {
+	// SweepInterval enables a background sweeper deleting the entries whose
+	// freshness lifetime ended more than SweepGrace ago. Without it, entries
+	// are only removed by Delete or Sweep.
+	SweepInterval time.Duration
+	SweepGrace    time.Duration
+}
+
+// Cache stores entries in a bbolt database. Every operation runs in a single
+// transaction, so that the headers and body of an entry are always updated
+// together.
+type Cache struct {
+	db     *bolt.DB
+	opts   Options
+	closer bool
+	stop   chan struct{}
+	once   sync.Once
+}
+
+var (
+	_ cah.Cache          = (*Cache)(nil)
+	_ cah.Enumerable     = (*Cache)(nil)
+	_ cah.TagInvalidator = (*Cache)(nil)
+)
+
+// Open opens or creates the database at path and returns a Cache using it
+func Open(path string, mode os.FileMode, opts Options) (*Cache, error) {
+	db, err := bolt.Open(path, mode, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(db, opts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c.closer = true
+	return c, nil
+}
+
+// New returns a Cache storing entries in an open database, creating its
+// buckets if needed
+func New(db *bolt.DB, opts Options) (*Cache, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, metaBucket, tagsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{db: db, opts: opts, stop: make(chan struct{})}
+	if opts.SweepInterval > 0 {
+		go c.sweeper(opts.SweepInterval)
+	}
+	return c, nil
+}
+
+// Close stops the background sweeper, and closes the database if it was
+// opened by Open
+func (c *Cache) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	if c.closer {
+		return c.db.Close()
+	}
+	return nil
+}
+
+func getMeta(tx *bolt.Tx, key string) keyMeta {
+	var m keyMeta
+	if b := tx.Bucket(metaBucket).Get([]byte(key)); b != nil {
+		json.Unmarshal(b, &m)
+	}
+	return m
+}
+
+func putMeta(tx *bolt.Tx, key string, m keyMeta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(metaBucket).Put([]byte(key), b)
+}
+
+// expires returns when the freshness lifetime of a resource ends
+func expires(res *cah.Resource) time.Time {
+	fresh := res.RemainingFreshness(false)
+	if shared := res.RemainingFreshness(true); shared > fresh {
+		fresh = shared
+	}
+	return cah.Clock().Add(fresh)
+}
+
+// index replaces the tags a key is indexed under
+func index(tx *bolt.Tx, key string, old, tags []string) error {
+	bucket := tx.Bucket(tagsBucket)
+	for _, tag := range old {
+		if b := bucket.Bucket([]byte(tag)); b != nil {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, tag := range tags {
+		b, err := bucket.CreateBucketIfNotExists([]byte(tag))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) info(key string) (h cah.Header, info cah.EntryInfo, err error) {
+	err = c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket).Get([]byte(key))
+		if b == nil {
+			return cah.ErrNotFoundInCache
+		}
+		if h, info, err = cah.UnmarshalEntryInfo(b); err != nil {
+			return cah.ErrNotFoundInCache
+		}
+		return nil
+	})
+	return h, info, err
+}
+
+func (c *Cache) Header(key string) (cah.Header, error) {
+	h, _, err := c.info(key)
+	return h, err
+}
+
+func (c *Cache) Stat(key string) (cah.EntryInfo, error) {
+	_, info, err := c.info(key)
+	return info, err
+}
+
+func (c *Cache) Store(res *cah.Resource, keys ...string) error {
+	e, err := cah.NewEntry(res, "")
+	if err != nil {
+		return err
+	}
+	exp := expires(res)
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			e.Key = key
+			b, err := e.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(entriesBucket).Put([]byte(key), b); err != nil {
+				return err
+			}
+
+			prev := getMeta(tx, key)
+			// earlier Vary variants are kept, so that Delete still erases
+			// them
+			variants := mergeVariants(key, prev.Variants, keys)
+			if err := index(tx, key, prev.Tags, e.Tags); err != nil {
+				return err
+			}
+			// the entry has been replaced, so any marker is outdated
+			m := keyMeta{Variants: variants, Tags: e.Tags, Expires: exp}
+			if err := putMeta(tx, key, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeVariants joins lists of variants without duplicates, leaving out key
+func mergeVariants(key string, lists ...[]string) []string {
+	var variants []string
+	seen := map[string]bool{key: true}
+	for _, list := range lists {
+		for _, variant := range list {
+			if !seen[variant] {
+				seen[variant] = true
+				variants = append(variants, variant)
+			}
+		}
+	}
+	return variants
+}
+
+func (c *Cache) Retrieve(key string) (*cah.Resource, error) {
+	var e cah.Entry
+	var m keyMeta
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entriesBucket).Get([]byte(key))
+		if b == nil {
+			return cah.ErrNotFoundInCache
+		}
+		// the entry is decoded into fresh memory, as b is only valid
+		// during the transaction
+		if err := e.UnmarshalBinary(b); err != nil {
+			return cah.ErrNotFoundInCache
+		}
+		m = getMeta(tx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := e.Resource()
+	if !m.Stale.IsZero() {
+		res.MarkStale()
+	}
+	return res, nil
+}
+
+func (c *Cache) Invalidate(keys ...string) {
+	c.db.Update(func(tx *bolt.Tx) error {
+		return invalidate(tx, keys)
+	})
+}
+
+func invalidate(tx *bolt.Tx, keys []string) error {
+	now := cah.Clock()
+	for _, key := range keys {
+		if tx.Bucket(entriesBucket).Get([]byte(key)) == nil {
+			continue
+		}
+		m := getMeta(tx, key)
+		m.Stale = now
+		if err := putMeta(tx, key, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateTags invalidates the entries tagged with any of the tags, using
+// the tags bucket as an index
+func (c *Cache) InvalidateTags(tags ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		var keys []string
+		for _, tag := range tags {
+			b := tx.Bucket(tagsBucket).Bucket([]byte(tag))
+			if b == nil {
+				continue
+			}
+			b.ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+		}
+		return invalidate(tx, keys)
+	})
+}
+
+// Delete erases the entries stored for the keys along with their variants
+func (c *Cache) Delete(keys ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		targets := append([]string(nil), keys...)
+		for _, key := range keys {
+			targets = append(targets, getMeta(tx, key).Variants...)
+		}
+
+		for _, key := range targets {
+			if err := remove(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove deletes the entry of a key along with its metadata and tags
+func remove(tx *bolt.Tx, key string) error {
+	if err := index(tx, key, getMeta(tx, key).Tags, nil); err != nil {
+		return err
+	}
+	if err := tx.Bucket(metaBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Delete([]byte(key))
+}
+
+func (c *Cache) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Sweep()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Sweep deletes the entries whose freshness lifetime ended more than
+// SweepGrace ago and returns how many were deleted
+func (c *Cache) Sweep() (int, error) {
+	deadline := cah.Clock().Add(-c.opts.SweepGrace)
+	var expired []string
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(metaBucket).ForEach(func(k, v []byte) error {
+			var m keyMeta
+			if json.Unmarshal(v, &m) == nil && !m.Expires.IsZero() && m.Expires.Before(deadline) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := remove(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Freshen updates the headers of the entries with a validated resource in a
+// single transaction
+func (c *Cache) Freshen(res *cah.Resource, keys ...string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			b := tx.Bucket(entriesBucket).Get([]byte(key))
+			if b == nil {
+				continue
+			}
+			var e cah.Entry
+			if err := e.UnmarshalBinary(b); err != nil {
+				continue
+			}
+
+			m := getMeta(tx, key)
+			if !e.Freshen(res) {
+				m.Stale = cah.Clock()
+			} else {
+				b, err := e.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				if err := tx.Bucket(entriesBucket).Put([]byte(key), b); err != nil {
+					return err
+				}
+				m.Stale = time.Time{}
+				m.Expires = expires(e.Resource())
+			}
+			if err := putMeta(tx, key, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Range calls fn for every entry in key order
+func (c *Cache) Range(fn func(cah.EntryInfo) bool) error {
+	return c.scan(nil, fn)
+}
+
+func (c *Cache) scan(prefix []byte, fn func(cah.EntryInfo) bool) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(entriesBucket).Cursor()
+		k, v := cur.First()
+		if len(prefix) > 0 {
+			k, v = cur.Seek(prefix)
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			_, info, err := cah.UnmarshalEntryInfo(v)
+			if err != nil {
+				continue
+			}
+			if !fn(info) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// InvalidatePrefix invalidates the entries whose key starts with prefix,
+// seeking to the prefix rather than scanning all the entries
+func (c *Cache) InvalidatePrefix(prefix string) (int, error) {
+	return c.invalidateWhere([]byte(prefix), func(cah.EntryInfo) bool { return true })
+}
+
+func (c *Cache) InvalidateMatch(re *regexp.Regexp) (int, error) {
+	return c.invalidateWhere(nil, func(info cah.EntryInfo) bool {
+		return re.MatchString(info.Key)
+	})
+}
+
+func (c *Cache) invalidateWhere(prefix []byte, match func(cah.EntryInfo) bool) (int, error) {
+	var keys []string
+	err := c.scan(prefix, func(info cah.EntryInfo) bool {
+		if match(info) {
+			keys = append(keys, info.Key)
+		}
+		return true
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return len(keys), c.db.Update(func(tx *bolt.Tx) error {
+		return invalidate(tx, keys)
+	})
+}
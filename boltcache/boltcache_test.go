@@ -0,0 +1,216 @@
+package boltcache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testKey = "GET:http://test.com"
+
+func setup(t *testing.T) *Cache {
+	c, err := Open(filepath.Join(t.TempDir(), "cache.db"), 0600, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func resource(body string, headers ...string) *cah.Resource {
+	h := make(http.Header)
+	h.Set("Date", cah.Clock().Format(http.TimeFormat))
+	for i := 0; i+1 < len(headers); i += 2 {
+		h.Set(headers[i], headers[i+1])
+	}
+	return cah.NewResourceBytes(200, []byte(body), h)
+}
+
+func TestCache_StoreRetrieve(t *testing.T) {
+	c := setup(t)
+
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+	assert.False(t, res.IsStale())
+
+	h, err := c.Header(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, h.StatusCode)
+
+	info, err := c.Stat(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, info.Key)
+	assert.Equal(t, int64(4), info.Size)
+
+	_, err = c.Retrieve("GET:http://missing.com")
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := Open(path, 0600, Options{})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Store(resource("body"), testKey))
+	c.Invalidate(testKey)
+	assert.Nil(t, c.Close())
+
+	c, err = Open(path, 0600, Options{})
+	assert.Nil(t, err)
+	defer c.Close()
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	c := setup(t)
+	assert.Nil(t, c.Store(resource("body"), testKey))
+
+	c.Invalidate(testKey, "GET:http://missing.com")
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	assert.Nil(t, c.Store(resource("body"), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_Freshen(t *testing.T) {
+	c := setup(t)
+	assert.Nil(t, c.Store(resource("body", "ETag", `"v1"`), testKey))
+	c.Invalidate(testKey)
+
+	assert.Nil(t, c.Freshen(resource("", "ETag", `"v1"`, "X-Validated", "yes"), testKey))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+	assert.Equal(t, "yes", res.Header().Get("X-Validated"))
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+
+	// a mismatching validator invalidates the entry
+	assert.Nil(t, c.Freshen(resource("", "ETag", `"v2"`), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+func TestCache_Delete(t *testing.T) {
+	c := setup(t)
+	variant := "GET:http://test.com?variant"
+	assert.Nil(t, c.Store(resource("body", cah.TagHeader, "a"), testKey, variant))
+
+	assert.Nil(t, c.Delete(testKey, "GET:http://missing.com"))
+	_, err := c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+	_, err = c.Retrieve(variant)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+
+	// deleted keys are removed from the tags index
+	assert.Nil(t, c.Store(resource("body"), testKey))
+	assert.Nil(t, c.InvalidateTags("a"))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_DeleteVariants(t *testing.T) {
+	c := setup(t)
+	json, html := testKey+"::Accept=json:", testKey+"::Accept=html:"
+	assert.Nil(t, c.Store(resource("json", "Vary", "Accept"), testKey, json))
+	assert.Nil(t, c.Store(resource("html", "Vary", "Accept"), testKey, html))
+
+	assert.Nil(t, c.Delete(testKey))
+	for _, key := range []string{testKey, json, html} {
+		_, err := c.Retrieve(key)
+		assert.Equal(t, cah.ErrNotFoundInCache, err, key)
+	}
+}
+
+func TestCache_InvalidateTags(t *testing.T) {
+	c := setup(t)
+	assert.Nil(t, c.Store(resource("a", cah.TagHeader, "catalog product-1"), "GET:http://test.com/a"))
+	assert.Nil(t, c.Store(resource("b", cah.TagHeader, "catalog"), "GET:http://test.com/b"))
+	assert.Nil(t, c.Store(resource("c", cah.TagHeader, "other"), "GET:http://test.com/c"))
+
+	assert.Nil(t, c.InvalidateTags("product-1", "missing"))
+	for key, stale := range map[string]bool{
+		"GET:http://test.com/a": true,
+		"GET:http://test.com/b": false,
+		"GET:http://test.com/c": false,
+	} {
+		res, err := c.Retrieve(key)
+		assert.Nil(t, err)
+		assert.Equal(t, stale, res.IsStale(), key)
+	}
+
+	// restoring without the tag drops it from the index
+	assert.Nil(t, c.Store(resource("b"), "GET:http://test.com/b"))
+	assert.Nil(t, c.InvalidateTags("catalog"))
+	res, _ := c.Retrieve("GET:http://test.com/b")
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_InvalidatePrefix(t *testing.T) {
+	c := setup(t)
+	for _, key := range []string{"GET:http://test.com/a/1", "GET:http://test.com/a/2", "GET:http://test.com/b"} {
+		assert.Nil(t, c.Store(resource("body"), key))
+	}
+
+	n, err := c.InvalidatePrefix("GET:http://test.com/a/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = c.InvalidateMatch(regexp.MustCompile(`/b$`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	var keys []string
+	assert.Nil(t, c.Range(func(info cah.EntryInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	}))
+	assert.Equal(t, []string{"GET:http://test.com/a/1", "GET:http://test.com/a/2", "GET:http://test.com/b"}, keys)
+}
+
+func TestCache_Sweep(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "cache.db"), 0600, Options{SweepGrace: time.Minute})
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Nil(t, c.Store(resource("a", "Cache-Control", "max-age=60", cah.TagHeader, "catalog"), "GET:http://test.com/a"))
+	assert.Nil(t, c.Store(resource("b", "Cache-Control", "max-age=3600"), "GET:http://test.com/b"))
+
+	n, err := c.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	defer func(clock func() time.Time) { cah.Clock = clock }(cah.Clock)
+	now := cah.Clock().Add(3 * time.Minute)
+	cah.Clock = func() time.Time { return now }
+	n, err = c.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = c.Retrieve("GET:http://test.com/a")
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+	_, err = c.Retrieve("GET:http://test.com/b")
+	assert.Nil(t, err)
+	c.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(metaBucket).Get([]byte("GET:http://test.com/a")))
+		assert.Nil(t, tx.Bucket(tagsBucket).Bucket([]byte("catalog")).Get([]byte("GET:http://test.com/a")))
+		return nil
+	})
+}
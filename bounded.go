@@ -0,0 +1,361 @@
+package negronicache
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+// BoundedOptions configures the limits of a BoundedCache
+type BoundedOptions struct {
+	// MaxBytes bounds the total size of the stored headers and bodies,
+	// zero means no limit
+	MaxBytes int64
+	// MaxEntries bounds the number of stored keys, zero means no limit
+	MaxEntries int
+	// Policy selects the entries evicted first, LRU by default
+	Policy EvictionPolicy
+	// OnEvict is called with the key and size of every evicted or swept
+	// entry. Legacy v1 entries found on disk at startup don't record their
+	// key and report its hash instead.
+	OnEvict func(key string, size int64)
+	// SweepInterval enables a background sweeper deleting the entries whose
+	// freshness lifetime ended more than SweepGrace ago
+	SweepInterval time.Duration
+	SweepGrace    time.Duration
+}
+
+// BoundedStats reports the usage and activity of a BoundedCache
+type BoundedStats struct {
+	Entries   int
+	Bytes     int64
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+}
+
+// BoundedCache is a Cache that evicts entries once it grows beyond its
+// limits. The header and body of an entry are always evicted together.
+type BoundedCache struct {
+	c       *cache
+	opts    BoundedOptions
+	mu      sync.Mutex
+	policy  evictionPolicy
+	entries map[string]*boundedEntry
+	stats   BoundedStats
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type boundedEntry struct {
+	key  string
+	size int64
+}
+
+var (
+	_ Cache    = (*BoundedCache)(nil)
+	_ Loggable = (*BoundedCache)(nil)
+	_ Evicter  = (*BoundedCache)(nil)
+)
+
+// NewBoundedMemoryCache returns an ephemeral cache in memory which evicts
+// entries, by default the least recently retrieved, once it is over its limits
+func NewBoundedMemoryCache(opts BoundedOptions) *BoundedCache {
+	return newBoundedCache(newVFSCache(vfs.Memory()), opts)
+}
+
+// NewBoundedDiskCache returns a disk-backed cache with a quota of
+// opts.MaxBytes. Entries already in dir are accounted for on startup, in
+// the order of their modification time.
+func NewBoundedDiskCache(dir string, opts BoundedOptions) (*BoundedCache, error) {
+	c, err := newDiskCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	b := newBoundedCache(c, opts)
+	if err := b.load(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func newBoundedCache(c *cache, opts BoundedOptions) *BoundedCache {
+	b := &BoundedCache{
+		c:       c,
+		opts:    opts,
+		policy:  opts.Policy.new(),
+		entries: map[string]*boundedEntry{},
+		stop:    make(chan struct{}),
+	}
+	if opts.SweepInterval > 0 {
+		go b.sweeper(opts.SweepInterval)
+	}
+	return b
+}
+
+// SetLogger sets the logger of the cache
+func (b *BoundedCache) SetLogger(l *slog.Logger) {
+	b.c.SetLogger(l)
+}
+
+// Close stops the background sweeper
+func (b *BoundedCache) Close() error {
+	b.once.Do(func() { close(b.stop) })
+	return nil
+}
+
+// Stats returns a snapshot of the cache usage
+func (b *BoundedCache) Stats() BoundedStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Entries = len(b.entries)
+	return stats
+}
+
+func (b *BoundedCache) Header(key string) (Header, error) {
+	return b.c.Header(key)
+}
+
+func (b *BoundedCache) Stat(key string) (EntryInfo, error) {
+	return b.c.Stat(key)
+}
+
+func (b *BoundedCache) Store(res *Resource, keys ...string) error {
+	err := b.c.Store(res, keys...)
+	b.track(keys...)
+	return err
+}
+
+// Retrieve returns a cached Resource for the given key and marks it as
+// recently used
+func (b *BoundedCache) Retrieve(key string) (*Resource, error) {
+	res, err := b.c.Retrieve(key)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.stats.Hits++
+		b.policy.Access(hashKey(key))
+	} else if err == ErrNotFoundInCache {
+		b.stats.Misses++
+	}
+	return res, err
+}
+
+func (b *BoundedCache) Invalidate(keys ...string) {
+	b.c.Invalidate(keys...)
+}
+
+func (b *BoundedCache) Delete(keys ...string) error {
+	hashes, err := b.c.delete(keys...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hash := range hashes {
+		if e, exists := b.entries[hash]; exists {
+			b.policy.Remove(hash)
+			delete(b.entries, hash)
+			b.stats.Bytes -= e.size
+		}
+	}
+	return err
+}
+
+func (b *BoundedCache) Freshen(res *Resource, keys ...string) error {
+	err := b.c.Freshen(res, keys...)
+	b.track(keys...)
+	return err
+}
+
+// track updates the size of the given keys and evicts entries until the
+// cache is within its limits again
+func (b *BoundedCache) track(keys ...string) {
+	b.mu.Lock()
+	for _, key := range keys {
+		b.add(hashKey(key), key)
+	}
+	evicted := b.evict()
+	b.mu.Unlock()
+
+	b.notify(evicted)
+}
+
+// add accounts for the current size of an entry, the caller must hold
+// the lock
+func (b *BoundedCache) add(hash, key string) {
+	size, err := b.c.size(hash)
+	if err != nil {
+		return
+	}
+	if e, exists := b.entries[hash]; exists {
+		b.stats.Bytes -= e.size
+	}
+	b.entries[hash] = &boundedEntry{key: key, size: size}
+	b.stats.Bytes += size
+	b.policy.Add(hash)
+}
+
+func (b *BoundedCache) notify(evicted []*boundedEntry) {
+	if b.opts.OnEvict != nil {
+		for _, e := range evicted {
+			b.opts.OnEvict(e.key, e.size)
+		}
+	}
+}
+
+// load accounts for the entries already stored, oldest first
+func (b *BoundedCache) load() error {
+	infos, err := b.c.entries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	b.mu.Lock()
+	for _, fi := range infos {
+		hash := fi.Name()
+		meta, err := b.c.readEntryMeta(hash)
+		if err == ErrNotFoundInCache {
+			// a v1 header without a body is left over from an interrupted write
+			b.c.remove(hash)
+			continue
+		} else if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		key := meta.Key
+		if key == "" {
+			key = hash
+		}
+		b.add(hash, key)
+	}
+	evicted := b.evict()
+	b.mu.Unlock()
+
+	logDebug(b.c.logger, "loaded cached entries", "entries", len(b.entries), "bytes", b.stats.Bytes)
+	b.notify(evicted)
+	return nil
+}
+
+// Victim returns the key of the entry evicted next, if the cache is at its
+// limits
+func (b *BoundedCache) Victim() (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	full := (b.opts.MaxBytes > 0 && b.stats.Bytes >= b.opts.MaxBytes) ||
+		(b.opts.MaxEntries > 0 && len(b.entries) >= b.opts.MaxEntries)
+	if !full {
+		return "", false
+	}
+	hash, ok := b.policy.Victim()
+	if !ok {
+		return "", false
+	}
+	return b.entries[hash].key, true
+}
+
+func (b *BoundedCache) overLimits() bool {
+	return (b.opts.MaxBytes > 0 && b.stats.Bytes > b.opts.MaxBytes) ||
+		(b.opts.MaxEntries > 0 && len(b.entries) > b.opts.MaxEntries)
+}
+
+// evict removes entries picked by the policy while over the limits, the
+// caller must hold the lock
+func (b *BoundedCache) evict() []*boundedEntry {
+	var evicted []*boundedEntry
+	for b.overLimits() {
+		hash, ok := b.policy.Victim()
+		if !ok {
+			break
+		}
+		e := b.drop(hash)
+		b.stats.Evictions++
+		logDebug(b.c.logger, "evicted", "key", e.key, "bytes", e.size)
+		evicted = append(evicted, e)
+	}
+	return evicted
+}
+
+// drop removes an entry from the cache, the caller must hold the lock
+func (b *BoundedCache) drop(hash string) *boundedEntry {
+	if err := b.c.remove(hash); err != nil {
+		logError(b.c.logger, "removing entry failed", err, "hash", hash)
+	}
+	e := b.entries[hash]
+	b.policy.Remove(hash)
+	delete(b.entries, hash)
+	b.stats.Bytes -= e.size
+	return e
+}
+
+func (b *BoundedCache) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Sweep()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Sweep deletes the entries whose freshness lifetime ended more than
+// SweepGrace ago
+func (b *BoundedCache) Sweep() {
+	b.mu.Lock()
+	hashes := make([]string, 0, len(b.entries))
+	for hash := range b.entries {
+		hashes = append(hashes, hash)
+	}
+	b.mu.Unlock()
+
+	var expired []*boundedEntry
+	for _, hash := range hashes {
+		h, err := b.c.header(hash)
+		if err != nil || !expiredFor(NewResource(h.StatusCode, nil, h.Header), b.opts.SweepGrace) {
+			continue
+		}
+
+		b.mu.Lock()
+		if _, exists := b.entries[hash]; exists {
+			e := b.drop(hash)
+			b.stats.Expired++
+			logDebug(b.c.logger, "swept expired entry", "key", e.key)
+			expired = append(expired, e)
+		}
+		b.mu.Unlock()
+	}
+
+	b.notify(expired)
+}
+
+// expiredFor reports whether a resource has been stale, for private and
+// shared caches alike, for longer than grace
+func expiredFor(res *Resource, grace time.Duration) bool {
+	age, err := res.Age()
+	if err != nil {
+		return false
+	}
+
+	lifetime := res.HeuristicFreshness()
+	for _, shared := range []bool{false, true} {
+		if maxAge, err := res.MaxAge(shared); err != nil {
+			return false
+		} else if maxAge > lifetime {
+			lifetime = maxAge
+		}
+	}
+
+	return age > lifetime+grace
+}
@@ -0,0 +1,131 @@
+package negronicache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeBytes(t *testing.T, c Cache, key, body string) {
+	res := NewResourceBytes(200, []byte(body), make(http.Header))
+	assert.Nil(t, c.Store(res, key))
+}
+
+func TestBoundedCache_MaxEntries(t *testing.T) {
+	var evicted []string
+	c := NewBoundedMemoryCache(BoundedOptions{
+		MaxEntries: 2,
+		OnEvict: func(key string, size int64) {
+			evicted = append(evicted, key)
+		},
+	})
+
+	storeBytes(t, c, "GET:http://a.com", "a")
+	storeBytes(t, c, "GET:http://b.com", "b")
+
+	// a becomes the most recently used entry
+	_, err := c.Retrieve("GET:http://a.com")
+	assert.Nil(t, err)
+
+	storeBytes(t, c, "GET:http://c.com", "c")
+	assert.Equal(t, []string{"GET:http://b.com"}, evicted)
+
+	_, err = c.Retrieve("GET:http://b.com")
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = c.Header("GET:http://b.com")
+	assert.Equal(t, ErrNotFoundInCache, err)
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestBoundedCache_MaxBytes(t *testing.T) {
+	c := NewBoundedMemoryCache(BoundedOptions{MaxBytes: 1000})
+
+	storeBytes(t, c, "GET:http://a.com", "0123456789")
+	size := c.Stats().Bytes
+	assert.True(t, size > 0 && size <= 1000)
+
+	for i := 0; i < 10; i++ {
+		storeBytes(t, c, "GET:http://b.com/"+string(rune('a'+i)), "0123456789")
+		assert.True(t, c.Stats().Bytes <= 1000)
+	}
+
+	_, err := c.Retrieve("GET:http://a.com")
+	assert.Equal(t, ErrNotFoundInCache, err)
+}
+
+func TestBoundedCache_DiskReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bounded")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewBoundedDiskCache(dir, BoundedOptions{MaxEntries: 2, Policy: LFU})
+	assert.Nil(t, err)
+	storeBytes(t, c, "GET:http://a.com", "a")
+	storeBytes(t, c, "GET:http://b.com", "b")
+	c.Close()
+
+	var evicted []string
+	c, err = NewBoundedDiskCache(dir, BoundedOptions{
+		MaxEntries: 2,
+		Policy:     LFU,
+		OnEvict: func(key string, size int64) {
+			evicted = append(evicted, key)
+		},
+	})
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, 2, c.Stats().Entries)
+
+	_, err = c.Retrieve("GET:http://a.com")
+	assert.Nil(t, err)
+	storeBytes(t, c, "GET:http://c.com", "c")
+	assert.Equal(t, []string{"GET:http://b.com"}, evicted)
+}
+
+func TestBoundedCache_Sweep(t *testing.T) {
+	c := NewBoundedMemoryCache(BoundedOptions{SweepGrace: time.Minute})
+	defer c.Close()
+
+	date := Clock().Add(-2 * time.Hour).Format(http.TimeFormat)
+	expired := make(http.Header)
+	expired.Set("Date", date)
+	expired.Set("Cache-Control", "max-age=3600")
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("old"), expired), "GET:http://expired.com"))
+
+	fresh := make(http.Header)
+	fresh.Set("Date", date)
+	fresh.Set("Cache-Control", "max-age=86400")
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("new"), fresh), "GET:http://fresh.com"))
+
+	c.Sweep()
+
+	_, err := c.Retrieve("GET:http://expired.com")
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = c.Retrieve("GET:http://fresh.com")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), c.Stats().Expired)
+}
+
+func TestBoundedCache_Delete(t *testing.T) {
+	c := NewBoundedMemoryCache(BoundedOptions{})
+	storeBytes(t, c, "GET:http://a.com", "a")
+	storeBytes(t, c, "GET:http://b.com", "b")
+
+	assert.Nil(t, c.Delete("GET:http://a.com"))
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, uint64(0), stats.Evictions)
+
+	size, err := c.c.size(hashKey("GET:http://b.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, size, stats.Bytes)
+}
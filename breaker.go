@@ -0,0 +1,111 @@
+package negronicache
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 10 * time.Second
+)
+
+// Breaker is a circuit breaker skipping the cache backend after repeated
+// lookup errors. Once open, it lets a single probe through every cooldown
+// and closes again when a probe succeeds.
+type Breaker struct {
+	// Threshold is the number of consecutive errors opening the breaker,
+	// 5 if zero
+	Threshold int
+	// Cooldown is the time between probes while the breaker is open, 10s
+	// if zero
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	probedAt time.Time
+}
+
+// NewBreaker returns a breaker opening after threshold consecutive errors
+// and probing the backend every cooldown
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *Breaker) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return defaultBreakerThreshold
+}
+
+func (b *Breaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return b.Cooldown
+	}
+	return defaultBreakerCooldown
+}
+
+// Allow reports whether the backend can be used, which is always the case
+// for a nil breaker
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold() {
+		return true
+	}
+	if now := time.Now(); now.Sub(b.probedAt) >= b.cooldown() {
+		b.probedAt = now
+		return true
+	}
+	return false
+}
+
+// Open reports whether the breaker is open, without letting a probe through
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold()
+}
+
+// Success records a successful use of the backend, closing the breaker
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Failure records an error of the backend, and reports whether it opened
+// the breaker
+func (b *Breaker) Failure() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures == b.threshold() {
+		b.probedAt = time.Now()
+		return true
+	}
+	return false
+}
+
+// FailClosed is an ErrorHandler responding 503 Service Unavailable when the
+// lookup fails, without passing the request upstream
+func FailClosed(rw http.ResponseWriter, r *http.Request, err error) {
+	http.Error(rw, http.StatusText(http.StatusServiceUnavailable),
+		http.StatusServiceUnavailable)
+}
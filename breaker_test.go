@@ -0,0 +1,107 @@
+package negronicache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyCache fails its retrievals while failing is set
+type flakyCache struct {
+	Cache
+	failing   atomic.Bool
+	retrieves atomic.Int64
+}
+
+func (c *flakyCache) Retrieve(key string) (*Resource, error) {
+	c.retrieves.Add(1)
+	if c.failing.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return c.Cache.Retrieve(key)
+}
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, 20*time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Failure())
+	assert.True(t, b.Allow())
+	assert.True(t, b.Failure())
+	assert.True(t, b.Open())
+	assert.False(t, b.Allow())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+	b.Failure()
+	assert.False(t, b.Allow())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow())
+	b.Success()
+	assert.False(t, b.Open())
+	assert.True(t, b.Allow())
+
+	var nilBreaker *Breaker
+	assert.True(t, nilBreaker.Allow())
+	assert.False(t, nilBreaker.Failure())
+}
+
+func TestMiddleware_FailOpen(t *testing.T) {
+	c := &flakyCache{Cache: NewMemoryCache()}
+	c.failing.Store(true)
+	mw := NewMiddleware(c)
+	mw.Breaker = NewBreaker(2, 50*time.Millisecond)
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "upstream")
+	}))
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/a", nil))
+		Writes.Wait()
+		return rec
+	}
+
+	for i := 0; i < 4; i++ {
+		rec := get()
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "upstream", rec.Body.String())
+		assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+	}
+	// the breaker opened after two errors
+	assert.Equal(t, int64(2), c.retrieves.Load())
+	stats := mw.CacheStats()
+	assert.Equal(t, int64(2), stats.Bypasses[BypassLookupError])
+	assert.Equal(t, int64(2), stats.Bypasses[BypassCircuitOpen])
+	// only the response fetched before the breaker opened is stored
+	assert.Equal(t, int64(1), stats.Stores)
+
+	c.failing.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "HIT", get().Header().Get(CacheHeader))
+	assert.Equal(t, int64(3), c.retrieves.Load())
+	assert.False(t, mw.Breaker.Open())
+}
+
+func TestMiddleware_FailClosed(t *testing.T) {
+	c := &flakyCache{Cache: NewMemoryCache()}
+	c.failing.Store(true)
+	mw := NewMiddleware(c)
+	mw.ErrorHandler = FailClosed
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request passed upstream")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/a", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "connection refused")
+}
@@ -0,0 +1,284 @@
+package negronicache
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dedupeWindow is the number of recent invalidation IDs remembered to drop
+// duplicate deliveries
+const dedupeWindow = 10000
+
+// Invalidation is broadcast to the other instances when entries are
+// invalidated or deleted
+type Invalidation struct {
+	// ID identifies the invalidation, duplicate deliveries are dropped
+	ID string `json:"id"`
+	// Origin identifies the instance which published the invalidation
+	Origin string    `json:"origin"`
+	Time   time.Time `json:"time"`
+	Keys   []string  `json:"keys,omitempty"`
+	Tags   []string  `json:"tags,omitempty"`
+	// Prefix and Match invalidate the entries whose key starts with Prefix
+	// or matches the regular expression Match, on the instances whose cache
+	// is Enumerable
+	Prefix string `json:"prefix,omitempty"`
+	Match  string `json:"match,omitempty"`
+	// Hard deletes the entries rather than marking them stale
+	Hard bool `json:"hard,omitempty"`
+}
+
+// InvalidationBus broadcasts invalidations between instances. Delivery is
+// best effort, and messages may be duplicated or reordered.
+type InvalidationBus interface {
+	// Publish sends an invalidation to every subscriber, possibly including
+	// the publisher
+	Publish(inv Invalidation) error
+	// Subscribe calls fn with every invalidation received
+	Subscribe(fn func(Invalidation)) error
+	Close() error
+}
+
+// LocalBus is an InvalidationBus delivering invalidations within the process,
+// e.g. between several caches or in tests
+type LocalBus struct {
+	mu   sync.RWMutex
+	subs []func(Invalidation)
+}
+
+var _ InvalidationBus = (*LocalBus)(nil)
+
+// NewLocalBus returns an in-process bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Publish delivers the invalidation to the subscribers before returning
+func (b *LocalBus) Publish(inv Invalidation) error {
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, fn := range subs {
+		fn(inv)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(fn func(Invalidation)) error {
+	b.mu.Lock()
+	b.subs = append(b.subs, fn)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *LocalBus) Close() error {
+	b.mu.Lock()
+	b.subs = nil
+	b.mu.Unlock()
+	return nil
+}
+
+// BroadcastCache publishes the invalidations and deletions of a local cache
+// on a bus, and applies those published by other instances to it.
+// Received invalidations are dropped if they were already applied, and
+// don't affect entries stored after they were published.
+type BroadcastCache struct {
+	Cache
+	bus    InvalidationBus
+	id     string
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+var (
+	_ Cache          = (*BroadcastCache)(nil)
+	_ TagInvalidator = (*BroadcastCache)(nil)
+	_ Enumerable     = (*BroadcastCache)(nil)
+	_ Loggable       = (*BroadcastCache)(nil)
+)
+
+// NewBroadcastCache subscribes to the bus and returns a cache sharing the
+// invalidations of local with the other instances
+func NewBroadcastCache(local Cache, bus InvalidationBus) (*BroadcastCache, error) {
+	b := &BroadcastCache{
+		Cache: local,
+		bus:   bus,
+		id:    randomID(),
+		seen:  map[string]bool{},
+	}
+	if err := bus.Subscribe(b.apply); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetLogger sets the logger reporting failures to publish or apply
+// invalidations
+func (b *BroadcastCache) SetLogger(l *slog.Logger) {
+	b.logger = l
+}
+
+func randomID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b)
+}
+
+func (b *BroadcastCache) publish(inv Invalidation) error {
+	inv.ID, inv.Origin, inv.Time = randomID(), b.id, Clock()
+	b.remember(inv.ID)
+	return b.bus.Publish(inv)
+}
+
+func (b *BroadcastCache) Invalidate(keys ...string) {
+	b.Cache.Invalidate(keys...)
+	if err := b.publish(Invalidation{Keys: keys}); err != nil {
+		logError(b.logger, "publishing invalidation failed", err, "keys", keys)
+	}
+}
+
+func (b *BroadcastCache) Delete(keys ...string) error {
+	if err := b.Cache.Delete(keys...); err != nil {
+		return err
+	}
+	return b.publish(Invalidation{Keys: keys, Hard: true})
+}
+
+// InvalidateTags invalidates the tagged entries of the local cache, if it
+// supports tags, and of the other instances
+func (b *BroadcastCache) InvalidateTags(tags ...string) error {
+	if ti, ok := b.Cache.(TagInvalidator); ok {
+		if err := ti.InvalidateTags(tags...); err != nil {
+			return err
+		}
+	}
+	return b.publish(Invalidation{Tags: tags})
+}
+
+// errNotEnumerable reports that the local cache can't list its entries
+var errNotEnumerable = errors.New("cache is not enumerable")
+
+// Range lists the entries of the local cache, if it is Enumerable
+func (b *BroadcastCache) Range(fn func(EntryInfo) bool) error {
+	en, ok := b.Cache.(Enumerable)
+	if !ok {
+		return errNotEnumerable
+	}
+	return en.Range(fn)
+}
+
+// InvalidatePrefix invalidates the entries whose key starts with prefix in
+// the local cache, if it is Enumerable, and in the other instances. It
+// returns how many local entries were invalidated.
+func (b *BroadcastCache) InvalidatePrefix(prefix string) (int, error) {
+	n := 0
+	if en, ok := b.Cache.(Enumerable); ok {
+		var err error
+		if n, err = en.InvalidatePrefix(prefix); err != nil {
+			return n, err
+		}
+	}
+	return n, b.publish(Invalidation{Prefix: prefix})
+}
+
+// InvalidateMatch invalidates the entries whose key matches re in the local
+// cache, if it is Enumerable, and in the other instances. It returns how
+// many local entries were invalidated.
+func (b *BroadcastCache) InvalidateMatch(re *regexp.Regexp) (int, error) {
+	n := 0
+	if en, ok := b.Cache.(Enumerable); ok {
+		var err error
+		if n, err = en.InvalidateMatch(re); err != nil {
+			return n, err
+		}
+	}
+	return n, b.publish(Invalidation{Match: re.String()})
+}
+
+// remember records an invalidation ID and reports whether it is new
+func (b *BroadcastCache) remember(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.seen[id] {
+		return false
+	}
+	b.seen[id] = true
+	b.order = append(b.order, id)
+	if len(b.order) > dedupeWindow {
+		delete(b.seen, b.order[0])
+		b.order = b.order[1:]
+	}
+	return true
+}
+
+// apply applies an invalidation received from the bus to the local cache
+func (b *BroadcastCache) apply(inv Invalidation) {
+	if inv.Origin == b.id || !b.remember(inv.ID) {
+		return
+	}
+
+	keys, err := b.matching(inv)
+	if err != nil {
+		logError(b.logger, "applying range invalidation failed", err,
+			"prefix", inv.Prefix, "match", inv.Match, "origin", inv.Origin)
+	}
+	for _, key := range inv.Keys {
+		// entries stored after the invalidation are already newer
+		if info, err := b.Cache.Stat(key); err == nil && info.StoredAt.After(inv.Time) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) > 0 {
+		if !inv.Hard {
+			b.Cache.Invalidate(keys...)
+		} else if err := b.Cache.Delete(keys...); err != nil {
+			logError(b.logger, "applying deletion failed", err, "keys", keys, "origin", inv.Origin)
+		}
+	}
+
+	if ti, ok := b.Cache.(TagInvalidator); ok && len(inv.Tags) > 0 {
+		if err := ti.InvalidateTags(inv.Tags...); err != nil {
+			logError(b.logger, "applying tag invalidation failed", err, "tags", inv.Tags, "origin", inv.Origin)
+		}
+	}
+}
+
+// matching lists the local entries invalidated by the Prefix or Match of a
+// received invalidation, leaving out those stored after it was published
+func (b *BroadcastCache) matching(inv Invalidation) ([]string, error) {
+	en, ok := b.Cache.(Enumerable)
+	if !ok || (inv.Prefix == "" && inv.Match == "") {
+		return nil, nil
+	}
+	var re *regexp.Regexp
+	if inv.Match != "" {
+		var err error
+		if re, err = regexp.Compile(inv.Match); err != nil {
+			return nil, err
+		}
+	}
+
+	var keys []string
+	err := en.Range(func(info EntryInfo) bool {
+		if inv.Prefix != "" && !strings.HasPrefix(info.Key, inv.Prefix) ||
+			re != nil && !re.MatchString(info.Key) || info.StoredAt.After(inv.Time) {
+			return true
+		}
+		keys = append(keys, info.Key)
+		return true
+	})
+	return keys, err
+}
@@ -0,0 +1,118 @@
+package negronicache
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func broadcastPair(t *testing.T, bus InvalidationBus) (*BroadcastCache, *BroadcastCache) {
+	a, err := NewBroadcastCache(NewMemoryCache(), bus)
+	assert.Nil(t, err)
+	b, err := NewBroadcastCache(NewMemoryCache(), bus)
+	assert.Nil(t, err)
+	return a, b
+}
+
+func isStale(t *testing.T, c Cache, key string) bool {
+	res, err := c.Retrieve(key)
+	if !assert.Nil(t, err) {
+		return false
+	}
+	return res.IsStale()
+}
+
+func TestBroadcastCache_Invalidate(t *testing.T) {
+	a, b := broadcastPair(t, NewLocalBus())
+	storeBytes(t, a, testKey, "a")
+	storeBytes(t, b, testKey, "b")
+
+	a.Invalidate(testKey)
+	assert.True(t, isStale(t, a, testKey))
+	assert.True(t, isStale(t, b, testKey))
+
+	assert.Nil(t, b.Delete(testKey))
+	for _, c := range []Cache{a, b} {
+		_, err := c.Retrieve(testKey)
+		assert.Equal(t, ErrNotFoundInCache, err)
+	}
+}
+
+func TestBroadcastCache_Tags(t *testing.T) {
+	a, b := broadcastPair(t, NewLocalBus())
+	h := make(http.Header)
+	h.Set(TagHeader, "catalog")
+	assert.Nil(t, b.Store(NewResourceBytes(200, []byte("b"), h), testKey))
+
+	assert.Nil(t, a.InvalidateTags("catalog"))
+	assert.True(t, isStale(t, b, testKey))
+}
+
+func TestBroadcastCache_InvalidatePrefix(t *testing.T) {
+	a, b := broadcastPair(t, NewLocalBus())
+	for _, c := range []Cache{a, b} {
+		storeBytes(t, c, "GET:http://example.com/catalog/1", "1")
+		storeBytes(t, c, "GET:http://example.com/catalog/2", "2")
+		storeBytes(t, c, "GET:http://example.com/cart", "cart")
+	}
+	// only stored on b
+	storeBytes(t, b, "GET:http://example.com/catalog/3", "3")
+
+	n, err := a.InvalidatePrefix("GET:http://example.com/catalog/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	for _, key := range []string{"GET:http://example.com/catalog/1", "GET:http://example.com/catalog/3"} {
+		assert.True(t, isStale(t, b, key))
+	}
+	assert.False(t, isStale(t, b, "GET:http://example.com/cart"))
+
+	n, err = b.InvalidateMatch(regexp.MustCompile(`/cart$`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, isStale(t, a, "GET:http://example.com/cart"))
+}
+
+func TestBroadcastCache_DedupeAndOrder(t *testing.T) {
+	bus := NewLocalBus()
+	_, b := broadcastPair(t, bus)
+	storeBytes(t, b, testKey, "b")
+
+	// an invalidation published before the entry was stored is ignored
+	old := Invalidation{ID: "1", Origin: "other", Time: Clock().Add(-time.Minute), Keys: []string{testKey}}
+	assert.Nil(t, bus.Publish(old))
+	assert.False(t, isStale(t, b, testKey))
+
+	inv := Invalidation{ID: "2", Origin: "other", Time: Clock().Add(time.Second), Keys: []string{testKey}}
+	assert.Nil(t, bus.Publish(inv))
+	assert.True(t, isStale(t, b, testKey))
+
+	// a duplicate delivery isn't applied again
+	storeBytes(t, b, testKey, "b")
+	assert.Nil(t, bus.Publish(inv))
+	assert.False(t, isStale(t, b, testKey))
+}
+
+func TestMulticastBus(t *testing.T) {
+	bus, err := NewMulticastBus("239.255.42.99:7946", nil)
+	if err != nil {
+		t.Skipf("multicast unavailable: %s", err)
+	}
+	defer bus.Close()
+
+	received := make(chan Invalidation, 1)
+	assert.Nil(t, bus.Subscribe(func(inv Invalidation) { received <- inv }))
+	assert.Nil(t, bus.Publish(Invalidation{ID: "1", Keys: []string{testKey}}))
+
+	select {
+	case inv := <-received:
+		assert.Equal(t, "1", inv.ID)
+		assert.Equal(t, []string{testKey}, inv.Keys)
+	case <-time.After(2 * time.Second):
+		t.Skip("multicast datagrams are not looped back")
+	}
+
+	assert.Equal(t, ErrInvalidationTooLarge, bus.Publish(Invalidation{Keys: []string{string(make([]byte, maxDatagramSize))}}))
+}
@@ -1,19 +1,19 @@
 package negronicache
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
-	"net/textproto"
 	"os"
 	pathutil "path"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rainycape/vfs"
@@ -22,7 +22,10 @@ import (
 const (
 	headerPrefix = "header/"
 	bodyPrefix   = "body/"
+	stalePrefix  = "stale/"
 	formatPrefix = "v1/"
+	entryPrefix  = "v2/"
+	tmpPrefix    = "tmp/"
 )
 
 // Returned when a resource doesn't exist
@@ -30,19 +33,37 @@ var ErrNotFoundInCache = errors.New("Not found in cache")
 
 type Cache interface {
 	Header(key string) (Header, error)
+	Stat(key string) (EntryInfo, error)
 	Store(res *Resource, keys ...string) error
 	Retrieve(key string) (*Resource, error)
 	Invalidate(keys ...string)
+	// Delete erases the entries stored for the keys, along with their Vary
+	// variants, whereas Invalidate only marks them stale
+	Delete(keys ...string) error
 	Freshen(res *Resource, keys ...string) error
 }
 
-// cache provides a storage mechanism for cached Resources
+// cache provides a storage mechanism for cached Resources. Entries are
+// stored in the v2 format, entries in the legacy v1 format are migrated
+// when they are retrieved.
 type cache struct {
-	fs    vfs.VFS
+	fs vfs.VFS
+	// rename atomically moves a written entry into place, if the VFS
+	// supports it
+	rename func(oldpath, newpath string) error
+	// fmu serializes moving entries into place with reading them
+	fmu sync.RWMutex
+	// stale holds the invalidation markers by hashed key, guarded by mu
+	mu    sync.RWMutex
 	stale map[string]time.Time
+	// logger is set by SetLogger, the package logger if nil
+	logger *slog.Logger
 }
 
-var _ Cache = (*cache)(nil)
+var (
+	_ Cache    = (*cache)(nil)
+	_ Loggable = (*cache)(nil)
+)
 
 type Header struct {
 	http.Header
@@ -51,7 +72,20 @@ type Header struct {
 
 // NewCache returns a cache backend off the provided VFS
 func NewVFSCache(fs vfs.VFS) Cache {
-	return &cache{fs: fs, stale: map[string]time.Time{}}
+	return newVFSCache(fs)
+}
+
+func newVFSCache(fs vfs.VFS) *cache {
+	c := &cache{fs: fs, stale: map[string]time.Time{}}
+	if r, ok := fs.(interface {
+		Rename(oldpath, newpath string) error
+	}); ok {
+		c.rename = r.Rename
+	}
+	if err := c.loadMarkers(); err != nil {
+		logError(nil, "loading stale markers failed", err)
+	}
+	return c
 }
 
 // NewMemoryCache returns an ephemeral cache in memory
@@ -61,6 +95,19 @@ func NewMemoryCache() Cache {
 
 // NewDiskCache returns a disk-backed cache
 func NewDiskCache(dir string) (Cache, error) {
+	c, err := newDiskCache(dir)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetLogger sets the logger of the cache
+func (c *cache) SetLogger(l *slog.Logger) {
+	c.logger = l
+}
+
+func newDiskCache(dir string) (*cache, error) {
 	if err := os.MkdirAll(dir, 0777); err != nil {
 		return nil, err
 	}
@@ -72,7 +119,13 @@ func NewDiskCache(dir string) (Cache, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewVFSCache(chfs), nil
+	c := newVFSCache(chfs)
+	c.rename = func(oldpath, newpath string) error {
+		return os.Rename(filepath.Join(dir, oldpath), filepath.Join(dir, newpath))
+	}
+	// temporary files are left over from interrupted writes
+	os.RemoveAll(filepath.Join(dir, tmpPrefix))
+	return c, nil
 }
 
 func (c *cache) vfsWrite(path string, r io.Reader) error {
@@ -90,149 +143,342 @@ func (c *cache) vfsWrite(path string, r io.Reader) error {
 	return nil
 }
 
-// Retrieve the Status and Headers for a given key path
-func (c *cache) Header(key string) (Header, error) {
-	path := headerPrefix + formatPrefix + hashKey(key)
-	f, err := c.fs.Open(path)
+var tmpCounter uint64
+
+// writeEntry writes an encoded entry to a temporary file and moves it into
+// place, so that readers never observe a partially written entry
+func (c *cache) writeEntry(hash string, meta entryMeta, body []byte) error {
+	buf := &bytes.Buffer{}
+	if err := encodeEntry(buf, meta, body); err != nil {
+		return err
+	}
+
+	path := entryPrefix + hash
+	if c.rename == nil {
+		c.fmu.Lock()
+		defer c.fmu.Unlock()
+		return c.vfsWrite(path, buf)
+	}
+
+	tmp := fmt.Sprintf("%s%s.%d", tmpPrefix, hash, atomic.AddUint64(&tmpCounter, 1))
+	if err := c.vfsWrite(tmp, buf); err != nil {
+		c.fs.Remove(tmp)
+		return err
+	}
+	if err := vfs.MkdirAll(c.fs, pathutil.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	return c.rename(tmp, path)
+}
+
+// readEntry reads and verifies the entry stored for a hashed key, falling
+// back to the v1 format. Corrupt entries are evicted and reported as not
+// found.
+func (c *cache) readEntry(hash, key string) (entryMeta, []byte, error) {
+	c.fmu.RLock()
+	f, err := c.fs.Open(entryPrefix + hash)
 	if err != nil {
+		c.fmu.RUnlock()
 		if vfs.IsNotExist(err) {
-			return Header{}, ErrNotFoundInCache
+			return c.migrate(hash, key)
 		}
-		return Header{}, err
+		return entryMeta{}, nil, err
 	}
+	meta, body, err := decodeEntry(f)
+	f.Close()
+	c.fmu.RUnlock()
 
-	return readHeaders(bufio.NewReader(f))
+	if err == errCorruptEntry {
+		logWarn(c.logger, "evicting corrupt entry", "hash", hash)
+		c.remove(hash)
+		return entryMeta{}, nil, ErrNotFoundInCache
+	}
+	return meta, body, err
 }
 
-// Store a resource against a number of keys
-func (c *cache) Store(res *Resource, keys ...string) error {
-	var buf = &bytes.Buffer{}
-
-	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
-		if _, err = io.CopyN(buf, res, length); err != nil {
-			return err
+// readEntryMeta reads the metadata of the entry stored for a hashed key
+// without reading its body
+func (c *cache) readEntryMeta(hash string) (entryMeta, error) {
+	c.fmu.RLock()
+	f, err := c.fs.Open(entryPrefix + hash)
+	if err != nil {
+		c.fmu.RUnlock()
+		if vfs.IsNotExist(err) {
+			return c.readV1Meta(hash)
 		}
-	} else if _, err = io.Copy(buf, res); err != nil {
-		return err
+		return entryMeta{}, err
 	}
+	meta, err := decodeEntryMeta(f)
+	f.Close()
+	c.fmu.RUnlock()
 
-	for _, key := range keys {
-		delete(c.stale, key)
+	if err == errCorruptEntry {
+		logWarn(c.logger, "evicting corrupt entry", "hash", hash)
+		c.remove(hash)
+		return entryMeta{}, ErrNotFoundInCache
+	}
+	return meta, err
+}
 
-		if err := c.storeBody(buf, key); err != nil {
-			return err
-		}
+// migrate rewrites an entry stored in the v1 format as a v2 entry
+func (c *cache) migrate(hash, key string) (entryMeta, []byte, error) {
+	meta, err := c.readV1Meta(hash)
+	if err != nil {
+		return entryMeta{}, nil, err
+	}
+	body, err := c.readV1Body(hash)
+	if err != nil {
+		return entryMeta{}, nil, err
+	}
 
-		if err := c.storeHeader(res.Status(), res.Header(), key); err != nil {
-			return err
-		}
+	meta.Key = key
+	if err := c.writeEntry(hash, meta, body); err != nil {
+		logError(c.logger, "migrating entry failed", err, "key", key)
+	} else if err := c.removeV1(hash); err != nil {
+		logError(c.logger, "removing v1 entry failed", err, "key", key)
 	}
+	return meta, body, nil
+}
 
-	return nil
+// Retrieve the Status and Headers for a given key path
+func (c *cache) Header(key string) (Header, error) {
+	return c.header(hashKey(key))
 }
 
-func (c *cache) storeBody(r io.Reader, key string) error {
-	if err := c.vfsWrite(bodyPrefix+formatPrefix+hashKey(key), r); err != nil {
-		return err
+func (c *cache) header(hash string) (Header, error) {
+	meta, err := c.readEntryMeta(hash)
+	if err != nil {
+		return Header{}, err
 	}
-	return nil
+	return Header{StatusCode: meta.Status, Header: meta.Header}, nil
 }
 
-func (c *cache) storeHeader(code int, h http.Header, key string) error {
-	hb := &bytes.Buffer{}
-	hb.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))))
-	headersToWriter(h, hb)
+// Stat returns the metadata of the entry stored for a key without
+// reading its body
+func (c *cache) Stat(key string) (EntryInfo, error) {
+	meta, err := c.readEntryMeta(hashKey(key))
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	if !meta.belongsTo(key) {
+		return EntryInfo{}, ErrNotFoundInCache
+	}
+	if meta.Key == "" {
+		meta.Key = key
+	}
+	return meta.EntryInfo, nil
+}
 
-	if err := c.vfsWrite(headerPrefix+formatPrefix+hashKey(key), bytes.NewReader(hb.Bytes())); err != nil {
+// Store a resource against a number of keys
+func (c *cache) Store(res *Resource, keys ...string) error {
+	body, err := readBody(res)
+	if err != nil {
 		return err
 	}
+
+	for _, key := range keys {
+		hash := hashKey(key)
+		meta := newEntryMeta(res, key, int64(len(body)))
+		meta.Variants = c.variants(hash, key, keys)
+		if err := c.writeEntry(hash, meta, body); err != nil {
+			return err
+		}
+
+		if err := c.removeV1(hash); err != nil {
+			return err
+		}
+
+		// the entry has been replaced, so any marker is outdated
+		if err := c.clearMarker(hash); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Retrieve returns a cached Resource for the given key
 func (c *cache) Retrieve(key string) (*Resource, error) {
-	f, err := c.fs.Open(bodyPrefix + formatPrefix + hashKey(key))
+	hash := hashKey(key)
+	meta, body, err := c.readEntry(hash, key)
 	if err != nil {
-		if vfs.IsNotExist(err) {
-			return nil, ErrNotFoundInCache
-		}
 		return nil, err
 	}
-	h, err := c.Header(key)
-	if err != nil {
-		if vfs.IsNotExist(err) {
-			return nil, ErrNotFoundInCache
-		}
-		return nil, err
+	if !meta.belongsTo(key) {
+		logWarn(c.logger, "hash collision", "key", key, "stored_key", meta.Key)
+		return nil, ErrNotFoundInCache
 	}
-	res := NewResource(h.StatusCode, f, h.Header)
-	if staleTime, exists := c.stale[key]; exists {
-		if !res.DateAfter(staleTime) {
-			log.Printf("stale marker of %s found", staleTime)
-			res.MarkStale()
-		}
+	res := NewResourceBytes(meta.Status, body, meta.Header)
+	res.RequestTime = meta.RequestTime
+	res.ResponseTime = meta.ResponseTime
+	if staleTime, exists := c.marker(hash); exists {
+		logDebug(c.logger, "stale marker found", "key", key, "invalidated", staleTime)
+		res.MarkStale()
 	}
 	return res, nil
 }
 
 func (c *cache) Invalidate(keys ...string) {
-	log.Printf("invalidating %q", keys)
+	logDebug(c.logger, "invalidating", "keys", keys)
 	for _, key := range keys {
-		c.stale[key] = Clock()
+		// markers are only written for stored entries, those of missing
+		// ones would outlive them
+		if _, err := c.Stat(key); err != nil {
+			continue
+		}
+		if err := c.setMarker(hashKey(key), Clock()); err != nil {
+			logError(c.logger, "invalidating failed", err, "key", key)
+		}
 	}
 }
 
 func (c *cache) Freshen(res *Resource, keys ...string) error {
 	for _, key := range keys {
-		if h, err := c.Header(key); err == nil {
-			if h.StatusCode == res.Status() && headersEqual(h.Header, res.Header()) {
-				debugf("freshening key %s", key)
-				if err := c.storeHeader(h.StatusCode, res.Header(), key); err != nil {
-					return err
-				}
-			} else {
-				debugf("freshen failed, invalidating %s", key)
-				c.Invalidate(key)
+		hash := hashKey(key)
+		meta, body, err := c.readEntry(hash, key)
+		if err != nil || !meta.belongsTo(key) {
+			continue
+		}
+		if meta.freshen(res) {
+			logDebug(c.logger, "freshening", "key", key)
+			meta.Key = key
+			if err := c.writeEntry(hash, meta, body); err != nil {
+				return err
 			}
+			if err := c.clearMarker(hash); err != nil {
+				return err
+			}
+		} else {
+			logDebug(c.logger, "validators mismatch, invalidating", "key", key)
+			c.Invalidate(key)
 		}
 	}
 	return nil
 }
 
-func hashKey(key string) string {
-	h := sha256.New()
-	io.WriteString(h, key)
-	return fmt.Sprintf("%x", h.Sum(nil))
+// variants returns the keys stored alongside key, merged with those already
+// recorded for its entry
+func (c *cache) variants(hash, key string, keys []string) []string {
+	seen := map[string]bool{key: true}
+	var variants []string
+	add := func(keys []string) {
+		for _, k := range keys {
+			if !seen[k] {
+				seen[k] = true
+				variants = append(variants, k)
+			}
+		}
+	}
+
+	if meta, err := c.readEntryMeta(hash); err == nil && meta.belongsTo(key) {
+		add(meta.Variants)
+	}
+	add(keys)
+	return variants
 }
 
-func readHeaders(r *bufio.Reader) (Header, error) {
-	tp := textproto.NewReader(r)
-	line, err := tp.ReadLine()
-	if err != nil {
-		return Header{}, err
+func (c *cache) Delete(keys ...string) error {
+	_, err := c.delete(keys...)
+	return err
+}
+
+// delete removes the entries of the keys and their variants, and returns
+// the hashes of the removed entries
+func (c *cache) delete(keys ...string) ([]string, error) {
+	logDebug(c.logger, "deleting", "keys", keys)
+	seen := map[string]bool{}
+	var hashes []string
+	for _, key := range keys {
+		hash := hashKey(key)
+		targets := []string{hash}
+		if meta, err := c.readEntryMeta(hash); err == nil && meta.belongsTo(key) {
+			for _, variant := range meta.Variants {
+				targets = append(targets, hashKey(variant))
+			}
+		}
+
+		for _, h := range targets {
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			if err := c.remove(h); err != nil {
+				return hashes, err
+			}
+			hashes = append(hashes, h)
+		}
 	}
+	return hashes, nil
+}
 
-	f := strings.SplitN(line, " ", 3)
-	if len(f) < 2 {
-		return Header{}, fmt.Errorf("malformed HTTP response: %s", line)
+// remove deletes the entry and the marker stored for a hashed key
+func (c *cache) remove(hash string) error {
+	c.fmu.Lock()
+	err := c.fs.Remove(entryPrefix + hash)
+	c.fmu.Unlock()
+	if err != nil && !vfs.IsNotExist(err) {
+		return err
 	}
-	statusCode, err := strconv.Atoi(f[1])
-	if err != nil {
-		return Header{}, fmt.Errorf("malformed HTTP status code: %s", f[1])
+	if err := c.removeV1(hash); err != nil {
+		return err
+	}
+	return c.clearMarker(hash)
+}
+
+// size returns the number of bytes used by the entry stored for a
+// hashed key
+func (c *cache) size(hash string) (int64, error) {
+	fi, err := c.fs.Stat(entryPrefix + hash)
+	if err == nil {
+		return fi.Size(), nil
+	} else if !vfs.IsNotExist(err) {
+		return 0, err
 	}
+	return c.sizeV1(hash)
+}
 
-	mimeHeader, err := tp.ReadMIMEHeader()
+// entries lists the stored entries, named after the hash of their key
+func (c *cache) entries() ([]os.FileInfo, error) {
+	infos, err := c.fs.ReadDir(entryPrefix)
+	if err != nil && !vfs.IsNotExist(err) {
+		return nil, err
+	}
+
+	v1, err := c.entriesV1()
 	if err != nil {
-		return Header{}, err
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, fi := range infos {
+		seen[fi.Name()] = true
+	}
+	for _, fi := range v1 {
+		if !seen[fi.Name()] {
+			infos = append(infos, fi)
+		}
 	}
-	return Header{StatusCode: statusCode, Header: http.Header(mimeHeader)}, nil
+	return infos, nil
 }
 
-func headersToWriter(h http.Header, w io.Writer) error {
-	if err := h.Write(w); err != nil {
-		return err
+func hashKey(key string) string {
+	h := sha256.New()
+	io.WriteString(h, key)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// readAll reads a file of the cache VFS
+func (c *cache) readAll(path string) ([]byte, error) {
+	f, err := c.fs.Open(path)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return nil, ErrNotFoundInCache
+		}
+		return nil, err
 	}
-	// ReadMIMEHeader expects a trailing newline
-	_, err := w.Write([]byte("\r\n"))
-	return err
+	defer f.Close()
+	return ioutil.ReadAll(f)
 }
@@ -2,9 +2,11 @@ package negronicache
 
 import (
 	"bytes"
+	"io/ioutil"
 	"net/http"
 	"testing"
 
+	"github.com/rainycape/vfs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,3 +53,90 @@ func TestCache_Header(t *testing.T) {
 
 	assert.Equal(t, "SKIP", h.Get(CacheHeader))
 }
+
+func TestCache_StoreMultipleKeys(t *testing.T) {
+	c := NewMemoryCache()
+	res := NewResourceBytes(200, []byte("shared body"), make(http.Header))
+	assert.Nil(t, c.Store(res, "GET:http://a.com", "GET:http://a.com::Accept=json:"))
+
+	for _, key := range []string{"GET:http://a.com", "GET:http://a.com::Accept=json:"} {
+		res, err := c.Retrieve(key)
+		assert.Nil(t, err)
+		b, _ := ioutil.ReadAll(res)
+		assert.Equal(t, "shared body", string(b))
+	}
+}
+
+func TestCache_RetrieveCorrupt(t *testing.T) {
+	c := newVFSCache(vfs.Memory())
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+
+	path := entryPrefix + hashKey(testKey)
+	b, err := c.readAll(path)
+	assert.Nil(t, err)
+	b[len(b)-1] ^= 0xff
+	assert.Nil(t, c.vfsWrite(path, bytes.NewReader(b)))
+
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = c.fs.Stat(path)
+	assert.True(t, vfs.IsNotExist(err))
+}
+
+func TestCache_Stat(t *testing.T) {
+	c := NewMemoryCache()
+	h := make(http.Header)
+	h.Set("Vary", "accept, Accept-Encoding")
+	res := NewResourceBytes(200, []byte("body"), h)
+	res.ResponseTime = Clock()
+	assert.Nil(t, c.Store(res, testKey))
+
+	info, err := c.Stat(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, info.Key)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, info.Vary)
+	assert.False(t, info.StoredAt.IsZero())
+	assert.True(t, info.ResponseTime.Equal(res.ResponseTime))
+
+	_, err = c.Stat("GET:http://missing.com")
+	assert.Equal(t, ErrNotFoundInCache, err)
+}
+
+func TestCache_HashCollision(t *testing.T) {
+	c := newVFSCache(vfs.Memory())
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+
+	// pretend another key hashes to the same entry
+	meta, body, err := c.readEntry(hashKey(testKey), testKey)
+	assert.Nil(t, err)
+	meta.Key = "GET:http://other.com"
+	assert.Nil(t, c.writeEntry(hashKey(testKey), meta, body))
+
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = c.Stat(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+}
+
+func TestCache_Delete(t *testing.T) {
+	c := newVFSCache(vfs.Memory())
+	vary := "GET:http://a.com::Accept=json:"
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), "GET:http://a.com", vary))
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("other"), make(http.Header)), "GET:http://b.com"))
+	c.Invalidate("GET:http://a.com")
+
+	assert.Nil(t, c.Delete("GET:http://a.com"))
+
+	for _, key := range []string{"GET:http://a.com", vary} {
+		_, err := c.Retrieve(key)
+		assert.Equal(t, ErrNotFoundInCache, err)
+		_, err = c.fs.Stat(entryPrefix + hashKey(key))
+		assert.True(t, vfs.IsNotExist(err))
+	}
+	_, exists := c.marker(hashKey("GET:http://a.com"))
+	assert.False(t, exists)
+
+	_, err := c.Retrieve("GET:http://b.com")
+	assert.Nil(t, err)
+}
@@ -0,0 +1,106 @@
+package negronicache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rainycape/vfs"
+)
+
+// The v1 format stores the status line and headers of an entry under
+// header/v1 and its body under body/v1, as two separately written files.
+// It is only read, to migrate existing caches to the v2 format.
+
+func (c *cache) readV1Header(hash string) (Header, error) {
+	b, err := c.readAll(headerPrefix + formatPrefix + hash)
+	if err != nil {
+		return Header{}, err
+	}
+	return readHeaders(bufio.NewReader(bytes.NewReader(b)))
+}
+
+// readV1Meta returns the metadata available for a v1 entry, which records
+// neither its key nor its times
+func (c *cache) readV1Meta(hash string) (entryMeta, error) {
+	h, err := c.readV1Header(hash)
+	if err != nil {
+		return entryMeta{}, err
+	}
+	fi, err := c.fs.Stat(bodyPrefix + formatPrefix + hash)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return entryMeta{}, ErrNotFoundInCache
+		}
+		return entryMeta{}, err
+	}
+	return entryMeta{
+		EntryInfo: EntryInfo{Size: fi.Size()},
+		Status:    h.StatusCode,
+		Header:    h.Header,
+	}, nil
+}
+
+func (c *cache) readV1Body(hash string) ([]byte, error) {
+	return c.readAll(bodyPrefix + formatPrefix + hash)
+}
+
+func (c *cache) removeV1(hash string) error {
+	for _, path := range []string{headerPrefix + formatPrefix + hash, bodyPrefix + formatPrefix + hash} {
+		if err := c.fs.Remove(path); err != nil && !vfs.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cache) sizeV1(hash string) (int64, error) {
+	var size int64
+	for _, path := range []string{headerPrefix + formatPrefix + hash, bodyPrefix + formatPrefix + hash} {
+		fi, err := c.fs.Stat(path)
+		if err != nil {
+			if vfs.IsNotExist(err) {
+				return 0, ErrNotFoundInCache
+			}
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+func (c *cache) entriesV1() ([]os.FileInfo, error) {
+	infos, err := c.fs.ReadDir(headerPrefix + formatPrefix)
+	if err != nil && vfs.IsNotExist(err) {
+		return nil, nil
+	}
+	return infos, err
+}
+
+func readHeaders(r *bufio.Reader) (Header, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return Header{}, err
+	}
+
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 {
+		return Header{}, fmt.Errorf("malformed HTTP response: %s", line)
+	}
+	statusCode, err := strconv.Atoi(f[1])
+	if err != nil {
+		return Header{}, fmt.Errorf("malformed HTTP status code: %s", f[1])
+	}
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{StatusCode: statusCode, Header: http.Header(mimeHeader)}, nil
+}
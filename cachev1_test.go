@@ -0,0 +1,39 @@
+package negronicache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rainycape/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheV1_Migrate(t *testing.T) {
+	c := newVFSCache(vfs.Memory())
+	hash := hashKey(testKey)
+
+	assert.Nil(t, c.vfsWrite(headerPrefix+formatPrefix+hash,
+		bytes.NewReader([]byte("HTTP/1.1 200 OK\r\nEtag: \"v1\"\r\n\r\n"))))
+	assert.Nil(t, c.vfsWrite(bodyPrefix+formatPrefix+hash,
+		bytes.NewReader([]byte("legacy body"))))
+
+	h, err := c.Header(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, `"v1"`, h.Get("ETag"))
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, res.Status())
+
+	// the entry has been rewritten in the v2 format
+	_, err = c.fs.Stat(entryPrefix + hash)
+	assert.Nil(t, err)
+	_, err = c.fs.Stat(bodyPrefix + formatPrefix + hash)
+	assert.True(t, vfs.IsNotExist(err))
+
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b := make([]byte, 11)
+	res.Read(b)
+	assert.Equal(t, "legacy body", string(b))
+}
@@ -0,0 +1,116 @@
+package negronicache
+
+import (
+	"context"
+)
+
+// ContextCache is a Cache whose operations honour the deadline and
+// cancellation of a context, so a slow backend can't block requests
+type ContextCache interface {
+	HeaderContext(ctx context.Context, key string) (Header, error)
+	StatContext(ctx context.Context, key string) (EntryInfo, error)
+	StoreContext(ctx context.Context, res *Resource, keys ...string) error
+	RetrieveContext(ctx context.Context, key string) (*Resource, error)
+	InvalidateContext(ctx context.Context, keys ...string) error
+	DeleteContext(ctx context.Context, keys ...string) error
+	FreshenContext(ctx context.Context, res *Resource, keys ...string) error
+}
+
+// AsContextCache returns c if it is a ContextCache, or otherwise adapts it
+// by running its operations in the background and returning the error of
+// the context once it is done. The abandoned operations still complete.
+func AsContextCache(c Cache) ContextCache {
+	if cc, ok := c.(ContextCache); ok {
+		return cc
+	}
+	return contextCache{c}
+}
+
+// contextCache adapts a Cache to a ContextCache
+type contextCache struct {
+	Cache
+}
+
+var _ ContextCache = contextCache{}
+
+// await runs f in the background until it completes or ctx is done. If ctx
+// is done first, abandon is called once f completes without error.
+func await(ctx context.Context, f func() error, abandon func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if abandon != nil {
+			go func() {
+				if err := <-done; err == nil {
+					abandon()
+				}
+			}()
+		}
+		return ctx.Err()
+	}
+}
+
+func (c contextCache) HeaderContext(ctx context.Context, key string) (Header, error) {
+	var h Header
+	err := await(ctx, func() (err error) {
+		h, err = c.Header(key)
+		return err
+	}, nil)
+	if err != nil {
+		return Header{}, err
+	}
+	return h, nil
+}
+
+func (c contextCache) StatContext(ctx context.Context, key string) (EntryInfo, error) {
+	var info EntryInfo
+	err := await(ctx, func() (err error) {
+		info, err = c.Stat(key)
+		return err
+	}, nil)
+	if err != nil {
+		return EntryInfo{}, err
+	}
+	return info, nil
+}
+
+func (c contextCache) StoreContext(ctx context.Context, res *Resource, keys ...string) error {
+	return await(ctx, func() error { return c.Store(res, keys...) }, nil)
+}
+
+func (c contextCache) RetrieveContext(ctx context.Context, key string) (*Resource, error) {
+	var res *Resource
+	err := await(ctx, func() (err error) {
+		res, err = c.Retrieve(key)
+		return err
+	}, func() { res.Close() })
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c contextCache) InvalidateContext(ctx context.Context, keys ...string) error {
+	return await(ctx, func() error {
+		c.Invalidate(keys...)
+		return nil
+	}, nil)
+}
+
+func (c contextCache) DeleteContext(ctx context.Context, keys ...string) error {
+	return await(ctx, func() error { return c.Delete(keys...) }, nil)
+}
+
+func (c contextCache) FreshenContext(ctx context.Context, res *Resource, keys ...string) error {
+	return await(ctx, func() error { return c.Freshen(res, keys...) }, nil)
+}
@@ -0,0 +1,71 @@
+package negronicache
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowCache delays retrievals until release is closed
+type slowCache struct {
+	Cache
+	release chan struct{}
+}
+
+func (c *slowCache) Retrieve(key string) (*Resource, error) {
+	<-c.release
+	return c.Cache.Retrieve(key)
+}
+
+func TestAsContextCache(t *testing.T) {
+	c := &slowCache{Cache: NewMemoryCache(), release: make(chan struct{})}
+	cc := AsContextCache(c)
+	assert.Equal(t, cc, AsContextCache(cc.(Cache)))
+
+	res := NewResourceBytes(200, []byte("body"), http.Header{"Cache-Control": {"max-age=60"}})
+	assert.Nil(t, cc.StoreContext(context.Background(), res, testKey))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cc.RetrieveContext(ctx, testKey)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(c.release)
+	res, err = cc.RetrieveContext(context.Background(), testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, cc.DeleteContext(canceled, testKey))
+	_, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+}
+
+func TestMiddleware_LookupTimeout(t *testing.T) {
+	c := &slowCache{Cache: NewMemoryCache(), release: make(chan struct{})}
+	defer close(c.release)
+	res := NewResourceBytes(200, []byte("cached"), http.Header{"Cache-Control": {"max-age=60"}})
+	assert.Nil(t, c.Store(res, "GET:http://example.com/a"))
+
+	mw := NewMiddleware(c)
+	mw.LookupTimeout = 10 * time.Millisecond
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/a", nil))
+	Writes.Wait()
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+	assert.Equal(t, "upstream", rec.Body.String())
+	assert.Equal(t, int64(1), mw.CacheStats().Bypasses[BypassLookupTimeout])
+}
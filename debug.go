@@ -1,20 +1,50 @@
 package negronicache
 
-import "log"
-
-const (
-	ansiRed   = "\x1b[31;1m"
-	ansiReset = "\x1b[0m"
-)
+import "log/slog"
 
+// DebugLogging enables the debug records of the package, which are further
+// filtered by the level of the slog handler
 var DebugLogging = true
 
-func debugf(format string, args ...interface{}) {
+// Logger is used by the middlewares, transports and caches which have no
+// logger of their own, slog.Default() if nil
+var Logger *slog.Logger
+
+// Loggable is implemented by caches whose logger can be set. The logger
+// should be set before the cache is used.
+type Loggable interface {
+	SetLogger(l *slog.Logger)
+}
+
+// WithLogger sets the logger of c if it is Loggable and returns c
+func WithLogger(c Cache, l *slog.Logger) Cache {
+	if lc, ok := c.(Loggable); ok {
+		lc.SetLogger(l)
+	}
+	return c
+}
+
+// loggerOr returns l, or the package logger if l is nil
+func loggerOr(l *slog.Logger) *slog.Logger {
+	switch {
+	case l != nil:
+		return l
+	case Logger != nil:
+		return Logger
+	}
+	return slog.Default()
+}
+
+func logDebug(l *slog.Logger, msg string, args ...any) {
 	if DebugLogging {
-		log.Printf(format, args...)
+		loggerOr(l).Debug(msg, args...)
 	}
 }
 
-func errorf(format string, args ...interface{}) {
-	log.Printf(ansiRed+"✗ "+format+ansiReset, args)
+func logWarn(l *slog.Logger, msg string, args ...any) {
+	loggerOr(l).Warn(msg, args...)
+}
+
+func logError(l *slog.Logger, msg string, err error, args ...any) {
+	loggerOr(l).Error(msg, append(args, "error", err)...)
 }
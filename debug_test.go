@@ -1 +1,92 @@
 package negronicache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func jsonLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+// records decodes the JSON records written to buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var recs []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &rec))
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestMiddleware_Logger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	mw := NewMiddleware(NewMemoryCache())
+	mw.Logger = jsonLogger(buf)
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(200)
+	}))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/logged", nil))
+		Writes.Wait()
+	}
+
+	var decisions []string
+	for _, rec := range records(t, buf) {
+		if rec["msg"] == "cache decision" {
+			assert.Equal(t, "GET", rec["method"])
+			assert.Equal(t, "GET:http://example.com/logged", rec["key"])
+			decisions = append(decisions, rec["decision"].(string))
+		}
+	}
+	assert.Equal(t, []string{"miss", "hit"}, decisions)
+	assert.NotContains(t, buf.String(), "\x1b[")
+}
+
+func TestWithLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	c := WithLogger(NewMemoryCache(), jsonLogger(buf))
+
+	storeBytes(t, c, testKey, "body")
+	c.Invalidate(testKey)
+
+	recs := records(t, buf)
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "invalidating", recs[0]["msg"])
+		assert.Equal(t, []interface{}{testKey}, recs[0]["keys"])
+	}
+}
+
+func TestLogError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logError(jsonLogger(buf), "storing failed", assert.AnError, "keys", []string{"a", "b"})
+
+	recs := records(t, buf)
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "ERROR", recs[0]["level"])
+		assert.Equal(t, assert.AnError.Error(), recs[0]["error"])
+		assert.Equal(t, []interface{}{"a", "b"}, recs[0]["keys"])
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	DebugLogging = false
+	defer func() { DebugLogging = true }()
+
+	logDebug(jsonLogger(buf), "hidden")
+	assert.Empty(t, buf.String())
+}
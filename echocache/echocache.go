@@ -0,0 +1,12 @@
+// Package echocache adapts the negroni-cache Middleware to the echo framework
+package echocache
+
+import (
+	"github.com/labstack/echo/v4"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+// Middleware returns an echo middleware serving responses through mw
+func Middleware(mw *cah.Middleware) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(mw.Handler)
+}
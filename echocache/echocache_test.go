@@ -0,0 +1,30 @@
+package echocache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware(cah.NewMiddleware(cah.NewMemoryCache())))
+	e.GET("/", func(c echo.Context) error {
+		c.Response().Header().Set("Cache-Control", "max-age=60")
+		return c.String(http.StatusOK, "echo")
+	})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	assert.Equal(t, "SKIP", rec.Header().Get(cah.CacheHeader))
+	cah.Writes.Wait()
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/", nil))
+	assert.Equal(t, "HIT", rec.Header().Get(cah.CacheHeader))
+	assert.Equal(t, "echo", rec.Body.String())
+}
@@ -0,0 +1,261 @@
+package negronicache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The v2 format stores an entry as a single file:
+//
+//	magic     "NCE2"
+//	uint32    length of the metadata, big endian
+//	uint32    CRC-32 of the metadata
+//	metadata  JSON encoded entryMeta
+//	body
+//	[32]byte  SHA-256 of the body
+//
+// The metadata checksum allows reading the headers without the body.
+
+var entryMagic = []byte("NCE2")
+
+var errCorruptEntry = errors.New("corrupt cache entry")
+
+// EntryInfo describes a cached entry
+type EntryInfo struct {
+	// Key is the original key the entry was stored against
+	Key          string    `json:"key"`
+	StoredAt     time.Time `json:"stored_at"`
+	RequestTime  time.Time `json:"request_time"`
+	ResponseTime time.Time `json:"response_time"`
+	// Vary lists the request headers named by the Vary response header
+	Vary []string `json:"vary,omitempty"`
+	// Size is the size of the body in bytes
+	Size int64 `json:"size"`
+	// Tags lists the tags of the Cache-Tag response header
+	Tags []string `json:"tags,omitempty"`
+}
+
+// entryMeta is the metadata stored alongside the body of an entry
+type entryMeta struct {
+	EntryInfo
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// Variants lists the other keys the resource was stored against, such
+	// as its Vary variants, which are deleted along with the entry
+	Variants []string `json:"variants,omitempty"`
+}
+
+// newEntryMeta returns the metadata for storing a resource against a key
+func newEntryMeta(res *Resource, key string, size int64) entryMeta {
+	var vary []string
+	for _, header := range strings.Split(res.Header().Get("Vary"), ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			vary = append(vary, http.CanonicalHeaderKey(header))
+		}
+	}
+
+	return entryMeta{
+		EntryInfo: EntryInfo{
+			Key:          key,
+			StoredAt:     Clock(),
+			RequestTime:  res.RequestTime,
+			ResponseTime: res.ResponseTime,
+			Vary:         vary,
+			Size:         size,
+			Tags:         res.Tags(),
+		},
+		Status: res.Status(),
+		Header: res.Header(),
+	}
+}
+
+func encodeEntry(w io.Writer, meta entryMeta, body []byte) error {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	var prefix [12]byte
+	copy(prefix[:4], entryMagic)
+	binary.BigEndian.PutUint32(prefix[4:8], uint32(len(m)))
+	binary.BigEndian.PutUint32(prefix[8:12], crc32.ChecksumIEEE(m))
+	sum := sha256.Sum256(body)
+
+	for _, b := range [][]byte{prefix[:], m, body, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeEntryMeta reads the metadata at the start of an entry
+func decodeEntryMeta(r io.Reader) (entryMeta, error) {
+	var meta entryMeta
+
+	var prefix [12]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return meta, errCorruptEntry
+	}
+	if !bytes.Equal(prefix[:4], entryMagic) {
+		return meta, errCorruptEntry
+	}
+
+	m := make([]byte, binary.BigEndian.Uint32(prefix[4:8]))
+	if _, err := io.ReadFull(r, m); err != nil {
+		return meta, errCorruptEntry
+	}
+	if crc32.ChecksumIEEE(m) != binary.BigEndian.Uint32(prefix[8:12]) {
+		return meta, errCorruptEntry
+	}
+	if err := json.Unmarshal(m, &meta); err != nil {
+		return meta, errCorruptEntry
+	}
+	return meta, nil
+}
+
+// decodeEntry reads a whole entry, verifying the checksum of its body
+func decodeEntry(r io.Reader) (entryMeta, []byte, error) {
+	br := bufio.NewReader(r)
+	meta, err := decodeEntryMeta(br)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	rest, err := ioutil.ReadAll(br)
+	if err != nil {
+		return meta, nil, err
+	}
+	if len(rest) < sha256.Size {
+		return meta, nil, errCorruptEntry
+	}
+
+	body, sum := rest[:len(rest)-sha256.Size], rest[len(rest)-sha256.Size:]
+	if actual := sha256.Sum256(body); !bytes.Equal(actual[:], sum) {
+		return meta, nil, errCorruptEntry
+	}
+	return meta, body, nil
+}
+
+// freshen updates the metadata with the headers of a validated resource,
+// and reports whether the resource matches the entry
+func (m *entryMeta) freshen(res *Resource) bool {
+	if m.Status != res.Status() || !headersEqual(m.Header, res.Header()) {
+		return false
+	}
+	m.Header = res.Header()
+	if !res.ResponseTime.IsZero() {
+		m.RequestTime = res.RequestTime
+		m.ResponseTime = res.ResponseTime
+	}
+	return true
+}
+
+// belongsTo reports whether the entry was stored against key. Entries
+// migrated from the v1 format don't record their key.
+func (m entryMeta) belongsTo(key string) bool {
+	return m.Key == "" || m.Key == key
+}
+
+// readBody reads the body of a resource, up to its Content-Length if set
+func readBody(res *Resource) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+
+	if length, err := strconv.ParseInt(res.Header().Get("Content-Length"), 10, 64); err == nil {
+		if _, err = io.CopyN(buf, res, length); err != nil {
+			return nil, err
+		}
+	} else if _, err = io.Copy(buf, res); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Entry is a resource stored against a key, in a serialized form for Cache
+// implementations which don't keep their entries in a VFS
+type Entry struct {
+	EntryInfo
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// NewEntry reads a resource into an Entry stored against key
+func NewEntry(res *Resource, key string) (*Entry, error) {
+	body, err := readBody(res)
+	if err != nil {
+		return nil, err
+	}
+	meta := newEntryMeta(res, key, int64(len(body)))
+	return &Entry{
+		EntryInfo:  meta.EntryInfo,
+		StatusCode: meta.Status,
+		Header:     meta.Header,
+		Body:       body,
+	}, nil
+}
+
+// Resource returns the Resource held by the entry
+func (e *Entry) Resource() *Resource {
+	res := NewResourceBytes(e.StatusCode, e.Body, e.Header)
+	res.RequestTime = e.RequestTime
+	res.ResponseTime = e.ResponseTime
+	return res
+}
+
+// Freshen updates the entry with the headers of a validated resource, and
+// reports whether the resource matches the entry
+func (e *Entry) Freshen(res *Resource) bool {
+	meta := e.meta()
+	if !meta.freshen(res) {
+		return false
+	}
+	e.EntryInfo, e.Header = meta.EntryInfo, meta.Header
+	return true
+}
+
+func (e *Entry) meta() entryMeta {
+	return entryMeta{EntryInfo: e.EntryInfo, Status: e.StatusCode, Header: e.Header}
+}
+
+// MarshalBinary encodes the entry in the v2 format, including checksums
+func (e *Entry) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := encodeEntry(buf, e.meta(), e.Body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes an entry in the v2 format, failing if its
+// checksums don't match
+func (e *Entry) UnmarshalBinary(b []byte) error {
+	meta, body, err := decodeEntry(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	e.EntryInfo, e.StatusCode, e.Header, e.Body = meta.EntryInfo, meta.Status, meta.Header, body
+	return nil
+}
+
+// UnmarshalEntryInfo decodes the status, headers and metadata of an entry
+// in the v2 format without verifying its body
+func UnmarshalEntryInfo(b []byte) (Header, EntryInfo, error) {
+	meta, err := decodeEntryMeta(bytes.NewReader(b))
+	if err != nil {
+		return Header{}, EntryInfo{}, err
+	}
+	return Header{StatusCode: meta.Status, Header: meta.Header}, meta.EntryInfo, nil
+}
@@ -0,0 +1,75 @@
+package negronicache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntry_EncodeDecode(t *testing.T) {
+	h := make(http.Header)
+	h.Set("ETag", `"abc"`)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, encodeEntry(buf, entryMeta{Status: 200, Header: h}, []byte("body")))
+
+	meta, err := decodeEntryMeta(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, meta.Status)
+	assert.Equal(t, `"abc"`, meta.Header.Get("ETag"))
+
+	meta, body, err := decodeEntry(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, meta.Status)
+	assert.Equal(t, "body", string(body))
+}
+
+func TestEntry_Corrupt(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, encodeEntry(buf, entryMeta{Status: 200, Header: make(http.Header)}, []byte("body")))
+	b := buf.Bytes()
+
+	truncated := b[:len(b)-10]
+	_, _, err := decodeEntry(bytes.NewReader(truncated))
+	assert.Equal(t, errCorruptEntry, err)
+
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)-sha256.Size-1] ^= 0xff
+	_, _, err = decodeEntry(bytes.NewReader(flipped))
+	assert.Equal(t, errCorruptEntry, err)
+
+	_, err = decodeEntryMeta(bytes.NewReader([]byte("garbage")))
+	assert.Equal(t, errCorruptEntry, err)
+}
+
+func TestEntry_MarshalBinary(t *testing.T) {
+	h := make(http.Header)
+	h.Set("ETag", `"abc"`)
+	e, err := NewEntry(NewResourceBytes(200, []byte("body"), h), testKey)
+	assert.Nil(t, err)
+
+	b, err := e.MarshalBinary()
+	assert.Nil(t, err)
+
+	var e2 Entry
+	assert.Nil(t, e2.UnmarshalBinary(b))
+	assert.Equal(t, testKey, e2.Key)
+	assert.Equal(t, int64(4), e2.Size)
+	assert.Equal(t, "body", string(e2.Body))
+
+	hdr, info, err := UnmarshalEntryInfo(b)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, hdr.StatusCode)
+	assert.Equal(t, testKey, info.Key)
+
+	h2 := make(http.Header)
+	h2.Set("ETag", `"def"`)
+	assert.False(t, e2.Freshen(NewResourceBytes(200, nil, h2)))
+	h2.Set("ETag", `"abc"`)
+	h2.Set("X-Fresh", "1")
+	assert.True(t, e2.Freshen(NewResourceBytes(200, nil, h2)))
+	assert.Equal(t, "1", e2.Resource().Header().Get("X-Fresh"))
+}
@@ -0,0 +1,158 @@
+package negronicache
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy selects the entries a bounded cache evicts first
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used entry
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used entry, breaking ties by recency
+	LFU
+)
+
+func (p EvictionPolicy) new() evictionPolicy {
+	if p == LFU {
+		return newLFUPolicy()
+	}
+	return newLRUPolicy()
+}
+
+// evictionPolicy orders the entries of a bounded cache by the hash of
+// their key and picks the next one to evict
+type evictionPolicy interface {
+	// Add starts tracking a newly stored entry
+	Add(hash string)
+	// Access records a hit on an entry
+	Access(hash string)
+	// Remove stops tracking an entry
+	Remove(hash string)
+	// Victim returns the entry that should be evicted next
+	Victim() (string, bool)
+}
+
+// lruPolicy evicts the least recently used entry
+type lruPolicy struct {
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (p *lruPolicy) Add(hash string) {
+	if e, ok := p.items[hash]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.items[hash] = p.ll.PushFront(hash)
+}
+
+func (p *lruPolicy) Access(hash string) {
+	if e, ok := p.items[hash]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(hash string) {
+	if e, ok := p.items[hash]; ok {
+		p.ll.Remove(e)
+		delete(p.items, hash)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	if e := p.ll.Back(); e != nil {
+		return e.Value.(string), true
+	}
+	return "", false
+}
+
+// lfuPolicy evicts the least frequently used entry
+type lfuPolicy struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	clock uint64
+}
+
+type lfuItem struct {
+	hash  string
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: map[string]*lfuItem{}}
+}
+
+func (p *lfuPolicy) Add(hash string) {
+	if _, ok := p.items[hash]; ok {
+		p.Access(hash)
+		return
+	}
+	p.clock++
+	item := &lfuItem{hash: hash, freq: 1, seq: p.clock}
+	p.items[hash] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy) Access(hash string) {
+	if item, ok := p.items[hash]; ok {
+		p.clock++
+		item.freq++
+		item.seq = p.clock
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(hash string) {
+	if item, ok := p.items[hash]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, hash)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].hash, true
+}
+
+// lfuHeap is a min-heap of items ordered by frequency, then recency
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,49 @@
+package negronicache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEviction_LRUPolicy(t *testing.T) {
+	p := newLRUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Access("a")
+
+	victim, ok := p.Victim()
+	assert.True(t, ok)
+	assert.Equal(t, "b", victim)
+
+	p.Remove("b")
+	victim, _ = p.Victim()
+	assert.Equal(t, "c", victim)
+
+	p.Remove("c")
+	p.Remove("a")
+	_, ok = p.Victim()
+	assert.False(t, ok)
+}
+
+func TestEviction_LFUPolicy(t *testing.T) {
+	p := newLFUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Access("a")
+	p.Access("a")
+	p.Access("c")
+
+	victim, ok := p.Victim()
+	assert.True(t, ok)
+	assert.Equal(t, "b", victim)
+
+	// ties are broken by recency
+	p.Remove("b")
+	p.Add("d")
+	p.Access("d")
+	victim, _ = p.Victim()
+	assert.Equal(t, "c", victim)
+}
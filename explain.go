@@ -0,0 +1,130 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DebugResponseHeader lists the decisions the middleware made for a request
+// in explain mode, see Middleware.DebugHeader
+const DebugResponseHeader = "X-Cache-Debug"
+
+// explainer collects the decisions made for a request. A nil explainer
+// discards them.
+type explainer struct {
+	steps []string
+}
+
+func (e *explainer) add(format string, args ...interface{}) {
+	if e != nil {
+		e.steps = append(e.steps, fmt.Sprintf(format, args...))
+	}
+}
+
+func (e *explainer) String() string {
+	return strings.Join(e.steps, "; ")
+}
+
+// explaining reports whether the request enabled explain mode and is
+// allowed to
+func (ch *Middleware) explaining(r *http.Request) bool {
+	return ch.DebugHeader != "" && r.Header.Get(ch.DebugHeader) != "" &&
+		ch.DebugAuthorizer != nil && ch.DebugAuthorizer(r)
+}
+
+// setExplanation sets the debug header of the response if explaining
+func setExplanation(h http.Header, r *CacheRequest) {
+	if r.explain != nil {
+		h.Set(DebugResponseHeader, r.explain.String())
+	}
+}
+
+// explainWriter explains whether an upstream response is cacheable as soon
+// as its headers are known, before they are written
+type explainWriter struct {
+	http.ResponseWriter
+	ch          *Middleware
+	r           *CacheRequest
+	wroteHeader bool
+}
+
+func (w *explainWriter) explain(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	res := NewResourceBytes(status, nil, w.Header())
+	if reason := w.ch.uncacheableReason(res, w.r); reason != "" {
+		w.r.explain.add("response not cacheable: %s", reason)
+	} else {
+		w.r.explain.add("response cacheable, storing as %s", strings.Join(storeKeys(res, w.r), ", "))
+		if fresh := res.RemainingFreshness(w.ch.Shared); fresh > 0 {
+			w.r.explain.add("fresh for %s", fresh.Round(time.Second))
+		} else if res.HasValidators() {
+			w.r.explain.add("stale on arrival, revalidated on use")
+		}
+	}
+	setExplanation(w.Header(), w.r)
+}
+
+func (w *explainWriter) WriteHeader(status int) {
+	w.explain(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *explainWriter) Write(b []byte) (int, error) {
+	w.explain(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+// explainFreshness explains how the freshness of a cached resource is
+// computed by freshness, in whole seconds
+func explainFreshness(res *Resource, r *CacheRequest, shared bool) {
+	if r.explain == nil {
+		return
+	}
+
+	if vary := res.Header().Get("Vary"); vary != "" {
+		r.explain.add("varies on %s, variant %s", vary, r.Key.Vary(vary, r.Request))
+	}
+
+	maxAge, err := res.MaxAge(shared)
+	if err != nil {
+		r.explain.add("invalid freshness lifetime: %s", err)
+		return
+	}
+	if res.Header().Get(TTLHeader) != "" {
+		r.explain.add("lifetime %s set by the TTL settings", maxAge.Round(time.Second))
+	} else {
+		r.explain.add("max-age %s", maxAge.Round(time.Second))
+	}
+
+	if reqMaxAge, err := r.CacheControl.Duration("max-age"); err == nil &&
+		r.CacheControl.Has("max-age") && reqMaxAge < maxAge {
+		r.explain.add("request max-age %s applied", reqMaxAge.Round(time.Second))
+		maxAge = reqMaxAge
+	}
+
+	age, err := res.Age()
+	if err != nil {
+		r.explain.add("age unknown: %s", err)
+		return
+	}
+	r.explain.add("age %s", age.Round(time.Second))
+
+	if res.IsStale() {
+		r.explain.add("marked stale by an invalidation")
+		return
+	}
+
+	if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
+		r.explain.add("heuristic freshness %s applied", hFresh.Round(time.Second))
+		maxAge = hFresh
+	} else {
+		r.explain.add("heuristic not applied")
+	}
+	r.explain.add("freshness %s", (maxAge - age).Round(time.Second))
+}
@@ -0,0 +1,105 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func explainMiddleware(handler http.HandlerFunc) http.Handler {
+	mw := NewMiddleware(NewMemoryCache())
+	mw.DebugHeader = "X-Debug-Cache"
+	mw.DebugAuthorizer = func(r *http.Request) bool {
+		return r.Header.Get("X-Debug-Token") == "secret"
+	}
+	return mw.Handler(handler)
+}
+
+func explain(h http.Handler, method, url string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("X-Debug-Cache", "1")
+	req.Header.Set("X-Debug-Token", "secret")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	Writes.Wait()
+	return rec
+}
+
+func TestMiddleware_ExplainSkip(t *testing.T) {
+	h := explainMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nostore" {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprint(w, "body")
+	})
+
+	rec := explain(h, "POST", "http://example.com/a")
+	assert.Contains(t, rec.Header().Get(DebugResponseHeader), "request not cacheable: method POST")
+
+	rec = explain(h, "GET", "http://example.com/a", "Cache-Control", "no-cache")
+	assert.Contains(t, rec.Header().Get(DebugResponseHeader), "request not cacheable: request Cache-Control no-cache")
+
+	rec = explain(h, "GET", "http://example.com/nostore")
+	assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+	assert.Equal(t, "key GET:http://example.com/nostore; not in cache; "+
+		"response not cacheable: response Cache-Control no-store", rec.Header().Get(DebugResponseHeader))
+}
+
+func TestMiddleware_ExplainHit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(clock func() time.Time) { Clock = clock }(Clock)
+	Clock = func() time.Time { return now }
+
+	h := explainMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		fmt.Fprint(w, "body")
+	})
+
+	rec := explain(h, "GET", "http://example.com/a", "Accept", "text/plain")
+	assert.Contains(t, rec.Header().Get(DebugResponseHeader),
+		"response cacheable, storing as GET:http://example.com/a, GET:http://example.com/a::Accept=text/plain")
+
+	rec = explain(h, "GET", "http://example.com/a", "Accept", "text/plain", "Cache-Control", "max-age=30")
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+	debug := rec.Header().Get(DebugResponseHeader)
+	for _, step := range []string{
+		"found in cache",
+		"varies on Accept, variant GET:http://example.com/a::Accept=text/plain",
+		"max-age 1m0s",
+		"request max-age 30s applied",
+		"age 0s",
+		"heuristic not applied",
+		"freshness 30s",
+	} {
+		assert.Contains(t, debug, step)
+	}
+}
+
+func TestMiddleware_ExplainUnauthorized(t *testing.T) {
+	h := explainMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	req := httptest.NewRequest("GET", "http://example.com/a", nil)
+	req.Header.Set("X-Debug-Cache", "1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	Writes.Wait()
+	assert.Empty(t, rec.Header().Get(DebugResponseHeader))
+
+	// the explanation isn't stored along with the response
+	rec = explain(h, "GET", "http://example.com/b")
+	assert.NotEmpty(t, rec.Header().Get(DebugResponseHeader))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/b", nil))
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+	assert.Empty(t, rec.Header().Get(DebugResponseHeader))
+}
@@ -32,13 +32,13 @@ func NewRequestKey(r *http.Request) Key {
 				u = r.URL.ResolveReference(u)
 			}
 			if u.Host != r.Host {
-				debugf("illegal host %q in Content-Location", u.Host)
+				logDebug(nil, "ignoring Content-Location with another host", "host", u.Host)
 			} else {
-				debugf("using Content-Location: %q", u.String())
+				logDebug(nil, "using Content-Location", "url", u.String())
 				URL = u
 			}
 		} else {
-			debugf("failed to parse Content-Location %q", location)
+			logDebug(nil, "parsing Content-Location failed", "location", location)
 		}
 	}
 
@@ -0,0 +1,80 @@
+package negronicache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rainycape/vfs"
+)
+
+// Invalidation markers record when a key was soft invalidated. They are
+// kept in memory and persisted under stale/v1 so that they survive a
+// restart of a disk-backed cache. They are only written for stored
+// entries and removed once the entry they refer to is replaced.
+
+func markerPath(hash string) string {
+	return stalePrefix + formatPrefix + hash
+}
+
+// loadMarkers reads the persisted markers into memory
+func (c *cache) loadMarkers() error {
+	infos, err := c.fs.ReadDir(stalePrefix + formatPrefix)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fi := range infos {
+		f, err := c.fs.Open(markerPath(fi.Name()))
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+		if err != nil {
+			logWarn(c.logger, "ignoring malformed stale marker", "hash", fi.Name())
+			continue
+		}
+		c.stale[fi.Name()] = t
+	}
+	return nil
+}
+
+// marker returns the time a hashed key was invalidated, if it was
+func (c *cache) marker(hash string) (time.Time, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t, exists := c.stale[hash]
+	return t, exists
+}
+
+func (c *cache) setMarker(hash string, t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale[hash] = t
+	return c.vfsWrite(markerPath(hash), bytes.NewReader([]byte(t.Format(time.RFC3339Nano))))
+}
+
+// clearMarker removes the marker of a hashed key
+func (c *cache) clearMarker(hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.stale[hash]; !exists {
+		return nil
+	}
+	delete(c.stale, hash)
+	if err := c.fs.Remove(markerPath(hash)); err != nil && !vfs.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
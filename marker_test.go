@@ -0,0 +1,75 @@
+package negronicache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/rainycape/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarker_WithoutDate(t *testing.T) {
+	c := NewMemoryCache()
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+
+	c.Invalidate(testKey)
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	// replacing the entry compacts the marker
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestMarker_MissingEntry(t *testing.T) {
+	c := newVFSCache(vfs.Memory())
+	c.Invalidate(testKey)
+	_, exists := c.marker(hashKey(testKey))
+	assert.False(t, exists)
+
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestMarker_Persisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marker")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c, err := NewDiskCache(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+	c.Invalidate(testKey)
+
+	c, err = NewDiskCache(dir)
+	assert.Nil(t, err)
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+func TestMarker_Concurrent(t *testing.T) {
+	c := NewMemoryCache()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey)
+			c.Retrieve(testKey)
+		}()
+		go func() {
+			defer wg.Done()
+			c.Invalidate(testKey)
+		}()
+	}
+	wg.Wait()
+}
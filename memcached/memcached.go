@@ -0,0 +1,415 @@
+// Package memcached provides a negroni-cache Cache backed by memcached.
+// Entries larger than the memcached item size limit are split into chunks
+// referenced by a manifest item.
+package memcached
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+const (
+	defaultNamespace = "negronicache:"
+	// defaultChunkSize leaves room for the key and the item overhead
+	// within the default 1 MB item size limit
+	defaultChunkSize = 1<<20 - 1024
+	// relativeExpirationLimit is the longest expiration memcached accepts
+	// in seconds, later ones are given as a unix timestamp
+	relativeExpirationLimit = 30 * 24 * time.Hour
+	freshenRetries          = 3
+)
+
+// Options configures a memcached Cache
+type Options struct {
+	// Namespace prefixes all the memcached keys, "negronicache:" by default
+	Namespace string
+	// Grace is added to the remaining freshness of a resource to derive the
+	// expiration of its entry, keeping stale entries around for
+	// revalidation. Resources without any freshness left are only stored
+	// if it is set.
+	Grace time.Duration
+	// Shared derives expirations from s-maxage rather than max-age
+	Shared bool
+	// ChunkSize is the largest item an entry is split into, just under
+	// 1 MB by default
+	ChunkSize int
+}
+
+// Cache stores entries in memcached. Keys are hashed to fit the memcached
+// key constraints:
+//
+//	<ns>m:<hash>               the manifest of the entry
+//	<ns>c:<hash>:<gen>:<n>     the chunks of the encoded entry
+//	<ns>s:<hash>               the invalidation marker
+//
+// A new generation of chunks is written before its manifest, so that
+// readers never mix chunks of different entries.
+type Cache struct {
+	client *memcache.Client
+	opts   Options
+}
+
+// manifest references the chunks of an entry
+type manifest struct {
+	Generation string `json:"gen"`
+	Chunks     int    `json:"chunks"`
+	// Expires is the unix time the entry expires at
+	Expires int64 `json:"expires"`
+	// Variants lists the keys stored alongside the entry
+	Variants []string `json:"variants,omitempty"`
+}
+
+var _ cah.Cache = (*Cache)(nil)
+
+// New returns a Cache storing entries with the given client
+func New(client *memcache.Client, opts Options) *Cache {
+	if opts.Namespace == "" {
+		opts.Namespace = defaultNamespace
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	return &Cache{client: client, opts: opts}
+}
+
+func hash(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+func (c *Cache) manifestKey(key string) string { return c.opts.Namespace + "m:" + hash(key) }
+func (c *Cache) markerKey(key string) string   { return c.opts.Namespace + "s:" + hash(key) }
+func (c *Cache) chunkKey(key, gen string, n int) string {
+	return c.opts.Namespace + "c:" + hash(key) + ":" + gen + ":" + strconv.Itoa(n)
+}
+
+// expiration converts an expiry time into a memcached expiration
+func expiration(expires time.Time) int32 {
+	ttl := expires.Sub(cah.Clock())
+	if ttl > relativeExpirationLimit {
+		return int32(expires.Unix())
+	}
+	secs := int32((ttl + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+func (c *Cache) getManifest(key string) (*memcache.Item, manifest, error) {
+	var m manifest
+	item, err := c.client.Get(c.manifestKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, m, cah.ErrNotFoundInCache
+	} else if err != nil {
+		return nil, m, err
+	}
+	if err := json.Unmarshal(item.Value, &m); err != nil {
+		return nil, m, cah.ErrNotFoundInCache
+	}
+	return item, m, nil
+}
+
+// chunks fetches the first n chunks of an entry and joins them
+func (c *Cache) chunks(key string, m manifest, n int) ([]byte, error) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = c.chunkKey(key, m.Generation, i)
+	}
+	items, err := c.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	for _, k := range keys {
+		item, ok := items[k]
+		if !ok {
+			// a chunk has been evicted
+			return nil, cah.ErrNotFoundInCache
+		}
+		b = append(b, item.Value...)
+	}
+	return b, nil
+}
+
+func (c *Cache) entry(key string) (*memcache.Item, manifest, *cah.Entry, error) {
+	item, m, err := c.getManifest(key)
+	if err != nil {
+		return nil, m, nil, err
+	}
+	b, err := c.chunks(key, m, m.Chunks)
+	if err != nil {
+		return nil, m, nil, err
+	}
+
+	e := &cah.Entry{}
+	if err := e.UnmarshalBinary(b); err != nil || e.Key != key {
+		return nil, m, nil, cah.ErrNotFoundInCache
+	}
+	return item, m, e, nil
+}
+
+func (c *Cache) info(key string) (cah.Header, cah.EntryInfo, error) {
+	_, m, err := c.getManifest(key)
+	if err != nil {
+		return cah.Header{}, cah.EntryInfo{}, err
+	}
+
+	// the metadata is at the start of the entry, normally within the
+	// first chunk
+	b, err := c.chunks(key, m, 1)
+	if err != nil {
+		return cah.Header{}, cah.EntryInfo{}, err
+	}
+	h, info, err := cah.UnmarshalEntryInfo(b)
+	if err != nil {
+		if _, _, e, err := c.entry(key); err == nil {
+			return cah.Header{StatusCode: e.StatusCode, Header: e.Header}, e.EntryInfo, nil
+		}
+		return cah.Header{}, cah.EntryInfo{}, cah.ErrNotFoundInCache
+	}
+	if info.Key != key {
+		return cah.Header{}, cah.EntryInfo{}, cah.ErrNotFoundInCache
+	}
+	return h, info, nil
+}
+
+func (c *Cache) Header(key string) (cah.Header, error) {
+	h, _, err := c.info(key)
+	return h, err
+}
+
+func (c *Cache) Stat(key string) (cah.EntryInfo, error) {
+	_, info, err := c.info(key)
+	return info, err
+}
+
+// write stores the chunks of an entry under a new generation and returns
+// the manifest item referencing them
+func (c *Cache) write(e *cah.Entry, expires time.Time, variants []string) (*memcache.Item, manifest, error) {
+	b, err := e.MarshalBinary()
+	if err != nil {
+		return nil, manifest{}, err
+	}
+
+	m := manifest{
+		Generation: strconv.FormatUint(rand.Uint64(), 36),
+		Expires:    expires.Unix(),
+		Variants:   variants,
+	}
+	exp := expiration(expires)
+	for len(b) > 0 || m.Chunks == 0 {
+		n := c.opts.ChunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		if err := c.client.Set(&memcache.Item{
+			Key:        c.chunkKey(e.Key, m.Generation, m.Chunks),
+			Value:      b[:n],
+			Expiration: exp,
+		}); err != nil {
+			return nil, m, err
+		}
+		b = b[n:]
+		m.Chunks++
+	}
+
+	v, err := json.Marshal(m)
+	if err != nil {
+		return nil, m, err
+	}
+	return &memcache.Item{Key: c.manifestKey(e.Key), Value: v, Expiration: exp}, m, nil
+}
+
+// deleteChunks deletes the chunks of a generation of an entry
+func (c *Cache) deleteChunks(key string, m manifest) error {
+	for i := 0; i < m.Chunks; i++ {
+		if err := c.client.Delete(c.chunkKey(key, m.Generation, i)); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeVariants joins lists of variants without duplicates, leaving out key
+func mergeVariants(key string, lists ...[]string) []string {
+	var variants []string
+	seen := map[string]bool{key: true}
+	for _, list := range lists {
+		for _, variant := range list {
+			if !seen[variant] {
+				seen[variant] = true
+				variants = append(variants, variant)
+			}
+		}
+	}
+	return variants
+}
+
+func (c *Cache) Store(res *cah.Resource, keys ...string) error {
+	ttl := res.RemainingFreshness(c.opts.Shared) + c.opts.Grace
+	if ttl <= 0 {
+		return nil
+	}
+	expires := cah.Clock().Add(ttl)
+
+	e, err := cah.NewEntry(res, "")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		e.Key = key
+		// earlier Vary variants are kept, so that Delete still erases them
+		_, prev, err := c.getManifest(key)
+		if err != nil && err != cah.ErrNotFoundInCache {
+			return err
+		}
+		variants := mergeVariants(key, prev.Variants, keys)
+
+		item, _, err := c.write(e, expires, variants)
+		if err != nil {
+			return err
+		}
+		if err := c.client.Set(item); err != nil {
+			return err
+		}
+		if prev.Generation != "" {
+			if err := c.deleteChunks(key, prev); err != nil {
+				return err
+			}
+		}
+		// the entry has been replaced, so any marker is outdated
+		if err := c.client.Delete(c.markerKey(key)); err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) Retrieve(key string) (*cah.Resource, error) {
+	_, _, e, err := c.entry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := e.Resource()
+	if _, err := c.client.Get(c.markerKey(key)); err == nil {
+		res.MarkStale()
+	} else if err != memcache.ErrCacheMiss {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Cache) Invalidate(keys ...string) {
+	for _, key := range keys {
+		_, m, err := c.getManifest(key)
+		if err != nil {
+			continue
+		}
+		c.client.Set(&memcache.Item{
+			Key:        c.markerKey(key),
+			Value:      []byte(strconv.FormatInt(cah.Clock().UnixNano(), 10)),
+			Expiration: expiration(time.Unix(m.Expires, 0)),
+		})
+	}
+}
+
+// Delete erases the entries stored for the keys along with their variants,
+// chunks and markers
+func (c *Cache) Delete(keys ...string) error {
+	targets := map[string]bool{}
+	for _, key := range keys {
+		targets[key] = true
+		if _, m, err := c.getManifest(key); err == nil {
+			for _, variant := range m.Variants {
+				targets[variant] = true
+			}
+		}
+	}
+
+	for key := range targets {
+		_, m, err := c.getManifest(key)
+		if err != nil && err != cah.ErrNotFoundInCache {
+			return err
+		}
+		if err := c.deleteChunks(key, m); err != nil {
+			return err
+		}
+		for _, k := range []string{c.manifestKey(key), c.markerKey(key)} {
+			if err := c.client.Delete(k); err != nil && err != memcache.ErrCacheMiss {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Freshen updates the headers of the entries with a validated resource,
+// swapping their manifest with compare-and-swap so that a concurrent store
+// isn't overwritten
+func (c *Cache) Freshen(res *cah.Resource, keys ...string) error {
+	for _, key := range keys {
+		for i := 0; i < freshenRetries; i++ {
+			err := c.freshen(res, key)
+			if err == memcache.ErrCASConflict {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (c *Cache) freshen(res *cah.Resource, key string) error {
+	item, m, e, err := c.entry(key)
+	if err == cah.ErrNotFoundInCache {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !e.Freshen(res) {
+		c.Invalidate(key)
+		return nil
+	}
+
+	expires := time.Unix(m.Expires, 0)
+	if ttl := e.Resource().RemainingFreshness(c.opts.Shared) + c.opts.Grace; ttl > 0 {
+		expires = cah.Clock().Add(ttl)
+	}
+
+	next, nextManifest, err := c.write(e, expires, m.Variants)
+	if err != nil {
+		return err
+	}
+	next.CasID = item.CasID
+	if err := c.client.CompareAndSwap(next); err != nil {
+		// the new generation is unreferenced
+		c.deleteChunks(key, nextManifest)
+		if err == memcache.ErrNotStored {
+			// the entry has been evicted meanwhile
+			return nil
+		}
+		return err
+	}
+	if err := c.deleteChunks(key, m); err != nil {
+		return err
+	}
+
+	if err := c.client.Delete(c.markerKey(key)); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
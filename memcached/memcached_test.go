@@ -0,0 +1,189 @@
+package memcached
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+const testKey = "GET:http://test.com"
+
+func setup(t *testing.T, opts Options) (*Cache, *fakeServer) {
+	s := newFakeServer(t)
+	return New(memcache.New(s.Addr()), opts), s
+}
+
+func resource(body string, headers ...string) *cah.Resource {
+	h := make(http.Header)
+	h.Set("Date", cah.Clock().Format(http.TimeFormat))
+	for i := 0; i+1 < len(headers); i += 2 {
+		h.Set(headers[i], headers[i+1])
+	}
+	return cah.NewResourceBytes(200, []byte(body), h)
+}
+
+func TestCache_StoreRetrieve(t *testing.T) {
+	c, s := setup(t, Options{Grace: time.Minute})
+
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+	ttl := s.ttl(c.manifestKey(testKey))
+	assert.True(t, ttl > time.Minute && ttl <= 2*time.Minute)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+	assert.False(t, res.IsStale())
+
+	h, err := c.Header(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, h.StatusCode)
+
+	info, err := c.Stat(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, info.Key)
+
+	s.now = func() time.Time { return time.Now().Add(3 * time.Minute) }
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_NoFreshness(t *testing.T) {
+	c, s := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body"), testKey))
+	assert.False(t, s.has(c.manifestKey(testKey)))
+	_, err := c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_Chunks(t *testing.T) {
+	c, s := setup(t, Options{ChunkSize: 64})
+	body := string(bytes.Repeat([]byte("0123456789"), 100))
+
+	assert.Nil(t, c.Store(resource(body, "Cache-Control", "max-age=60"), testKey))
+	assert.True(t, len(s.keys(c.opts.Namespace+"c:")) > 10)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, body, string(b))
+
+	// metadata spanning several chunks is still readable
+	info, err := c.Stat(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, info.Key)
+
+	// losing any chunk loses the entry
+	chunks := s.keys(c.opts.Namespace + "c:")
+	s.mu.Lock()
+	delete(s.items, chunks[len(chunks)/2])
+	s.mu.Unlock()
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	c, s := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+
+	c.Invalidate(testKey, "GET:http://missing.com")
+	assert.False(t, s.has(c.markerKey("GET:http://missing.com")))
+	assert.True(t, s.ttl(c.markerKey(testKey)) > 0)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_Delete(t *testing.T) {
+	c, s := setup(t, Options{})
+	variant := "GET:http://test.com?variant"
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey, variant))
+	c.Invalidate(testKey)
+
+	assert.Nil(t, c.Delete(testKey, "GET:http://missing.com"))
+	assert.False(t, s.has(c.manifestKey(testKey)))
+	assert.False(t, s.has(c.manifestKey(variant)))
+	assert.False(t, s.has(c.markerKey(testKey)))
+	assert.Empty(t, s.keys(c.opts.Namespace+"c:"))
+
+	_, err := c.Retrieve(variant)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_DeleteVariants(t *testing.T) {
+	c, s := setup(t, Options{})
+	json, html := testKey+"::Accept=json:", testKey+"::Accept=html:"
+	assert.Nil(t, c.Store(resource("json", "Cache-Control", "max-age=60", "Vary", "Accept"), testKey, json))
+	assert.Nil(t, c.Store(resource("html", "Cache-Control", "max-age=60", "Vary", "Accept"), testKey, html))
+	// replacing an entry deletes the chunks of the previous one
+	assert.Len(t, s.keys(c.opts.Namespace+"c:"), 3)
+
+	assert.Nil(t, c.Delete(testKey))
+	for _, key := range []string{testKey, json, html} {
+		assert.False(t, s.has(c.manifestKey(key)), key)
+	}
+	assert.Empty(t, s.keys(c.opts.Namespace+"c:"))
+}
+
+func TestCache_Freshen(t *testing.T) {
+	c, s := setup(t, Options{})
+	stored := resource("body", "Cache-Control", "max-age=60", "ETag", `"v1"`)
+	assert.Nil(t, c.Store(stored, testKey))
+	c.Invalidate(testKey)
+
+	validated := resource("", "Cache-Control", "max-age=120", "ETag", `"v1"`, "X-Validated", "yes")
+	assert.Nil(t, c.Freshen(validated, testKey))
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+	assert.Equal(t, "yes", res.Header().Get("X-Validated"))
+	// the chunks of the previous generation are deleted
+	assert.Len(t, s.keys(c.opts.Namespace+"c:"), 1)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+
+	// a mismatching validator invalidates the entry
+	assert.Nil(t, c.Freshen(resource("", "ETag", `"v2"`), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+func TestCache_FreshenConflict(t *testing.T) {
+	c, _ := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60", "ETag", `"v1"`), testKey))
+
+	item, _, _, err := c.entry(testKey)
+	assert.Nil(t, err)
+
+	// a concurrent store replaces the manifest
+	assert.Nil(t, c.Store(resource("other", "Cache-Control", "max-age=60", "ETag", `"v1"`), testKey))
+
+	e := &cah.Entry{}
+	e.Key = testKey
+	next, _, err := c.write(e, cah.Clock().Add(time.Minute), nil)
+	assert.Nil(t, err)
+	next.CasID = item.CasID
+	assert.Equal(t, memcache.ErrCASConflict, c.client.CompareAndSwap(next))
+
+	// freshening retries against the current manifest
+	assert.Nil(t, c.Freshen(resource("", "ETag", `"v1"`, "X-Validated", "yes"), testKey))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "other", string(b))
+	assert.Equal(t, "yes", res.Header().Get("X-Validated"))
+}
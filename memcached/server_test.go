@@ -0,0 +1,211 @@
+package memcached
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeItem is an item held by the fake server
+type fakeItem struct {
+	value   []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+// fakeServer speaks the subset of the memcached text protocol used by
+// gomemcache: get, gets, set, add, replace, cas, delete and touch
+type fakeServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	items map[string]*fakeItem
+	cas   uint64
+	now   func() time.Time
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, items: map[string]*fakeItem{}, now: time.Now}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) Addr() string { return s.ln.Addr().String() }
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// get returns a live item, the caller must hold the lock
+func (s *fakeServer) get(key string) *fakeItem {
+	item, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !item.expires.IsZero() && !s.now().Before(item.expires) {
+		delete(s.items, key)
+		return nil
+	}
+	return item
+}
+
+// has reports whether a live item is stored for the key
+func (s *fakeServer) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key) != nil
+}
+
+// ttl returns how long until the item for the key expires
+func (s *fakeServer) ttl(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item := s.get(key); item != nil && !item.expires.IsZero() {
+		return item.expires.Sub(s.now())
+	}
+	return 0
+}
+
+// keys returns the live keys with the given prefix
+func (s *fakeServer) keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.items {
+		if strings.HasPrefix(key, prefix) && s.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *fakeServer) expiry(exp int64) time.Time {
+	switch {
+	case exp == 0:
+		return time.Time{}
+	case exp > 30*24*60*60:
+		return time.Unix(exp, 0)
+	}
+	return s.now().Add(time.Duration(exp) * time.Second)
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch cmd := fields[0]; cmd {
+		case "get", "gets":
+			s.mu.Lock()
+			for _, key := range fields[1:] {
+				if item := s.get(key); item != nil {
+					fmt.Fprintf(w, "VALUE %s %d %d", key, item.flags, len(item.value))
+					if cmd == "gets" {
+						fmt.Fprintf(w, " %d", item.cas)
+					}
+					fmt.Fprintf(w, "\r\n%s\r\n", item.value)
+				}
+			}
+			s.mu.Unlock()
+			w.WriteString("END\r\n")
+
+		case "set", "add", "replace", "cas":
+			flags, _ := strconv.ParseUint(fields[2], 10, 32)
+			exp, _ := strconv.ParseInt(fields[3], 10, 64)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			w.WriteString(s.store(cmd, fields, &fakeItem{
+				value:   value[:size],
+				flags:   uint32(flags),
+				expires: s.expiry(exp),
+			}) + "\r\n")
+
+		case "delete":
+			s.mu.Lock()
+			if s.get(fields[1]) != nil {
+				delete(s.items, fields[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+			s.mu.Unlock()
+
+		case "touch":
+			exp, _ := strconv.ParseInt(fields[2], 10, 64)
+			s.mu.Lock()
+			if item := s.get(fields[1]); item != nil {
+				item.expires = s.expiry(exp)
+				w.WriteString("TOUCHED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+			s.mu.Unlock()
+
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) store(cmd string, fields []string, item *fakeItem) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := fields[1]
+	existing := s.get(key)
+	switch cmd {
+	case "add":
+		if existing != nil {
+			return "NOT_STORED"
+		}
+	case "replace":
+		if existing == nil {
+			return "NOT_STORED"
+		}
+	case "cas":
+		if existing == nil {
+			return "NOT_FOUND"
+		}
+		if cas, _ := strconv.ParseUint(fields[5], 10, 64); cas != existing.cas {
+			return "EXISTS"
+		}
+	}
+
+	s.cas++
+	item.cas = s.cas
+	s.items[key] = item
+	return "STORED"
+}
@@ -2,13 +2,20 @@ package negronicache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"math"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -17,6 +24,8 @@ const (
 	GRPCStatusOK    = 0
 )
 
+// Writes tracks the background writes of all the middlewares, whereas
+// Middleware.Close waits for those of a single one
 var Writes sync.WaitGroup
 
 var storeable = map[int]bool{
@@ -44,67 +53,356 @@ var cacheableByDefault = map[int]bool{
 	http.StatusPartialContent:       true,
 }
 
+// PurgeMode selects how Middleware.Purge removes entries from the cache
+type PurgeMode int
+
+const (
+	// SoftPurge marks entries stale, so they are revalidated before reuse
+	SoftPurge PurgeMode = iota
+	// HardPurge erases entries, along with their Vary variants
+	HardPurge
+)
+
 // Middleware is the cache middlware for negroni
 type Middleware struct {
-	Shared    bool
-	validator *Validator
-	cache     Cache
+	Shared bool
+	// TracerProvider creates the spans of the middleware, the global
+	// provider if nil
+	TracerProvider trace.TracerProvider
+	// Logger receives the records of the middleware, the package Logger if
+	// nil
+	Logger *slog.Logger
+	// DebugHeader names a request header enabling explain mode, in which
+	// the X-Cache-Debug response header lists the decisions made for the
+	// request. Explain mode is disabled if empty.
+	DebugHeader string
+	// DebugAuthorizer allows a request to use explain mode, which is never
+	// enabled if nil
+	DebugAuthorizer func(r *http.Request) bool
+	// LookupTimeout bounds the time spent looking a request up in the
+	// cache, after which the request is passed upstream. Lookups are only
+	// bounded by the request context if zero.
+	LookupTimeout time.Duration
+	// Breaker skips the cache after repeated lookup errors, which are
+	// never skipped if nil
+	Breaker *Breaker
+	// ErrorHandler responds to requests whose lookup failed, such as
+	// FailClosed. Those requests are passed upstream if nil.
+	ErrorHandler func(rw http.ResponseWriter, r *http.Request, err error)
+	// WriteWorkers is the number of goroutines storing responses in the
+	// background, 4 if zero
+	WriteWorkers int
+	// WriteQueue is the number of responses waiting to be stored, beyond
+	// which the WriteDropPolicy applies, 64 if zero
+	WriteQueue int
+	// WriteDropPolicy selects the write dropped when the queue is full
+	WriteDropPolicy DropPolicy
+	// Admission decides which cacheable responses are stored, all of them
+	// if nil
+	Admission AdmissionPolicy
+	// EarlyRefresh enables refreshing popular entries in the background
+	// before they expire, with a probability growing as they approach
+	// expiry, scaled by this factor. 1 is a sensible value, and zero
+	// disables early refreshes. The next handler must then be safe to call
+	// after the request completed.
+	EarlyRefresh float64
+	// MinTTL and MaxTTL bound the freshness lifetime of the stored
+	// responses, zero meaning no bound
+	MinTTL, MaxTTL time.Duration
+	// TTLRules replace MinTTL and MaxTTL for the requests whose path starts
+	// with their prefix, the rule with the longest prefix applying
+	TTLRules []TTLRule
+	// TTLOverrideHeader names a response header, such as X-Accel-Expires,
+	// setting the freshness lifetime of the response in seconds, or as a
+	// unix time if prefixed with @, within MinTTL and MaxTTL. A lifetime of
+	// 0 prevents storing the response. The header isn't sent to clients.
+	TTLOverrideHeader string
+	// TTLJitter shortens the freshness lifetime of each stored entry by up
+	// to this fraction, depending on its key, so that entries stored
+	// together don't expire together
+	TTLJitter  float64
+	cache      Cache
+	ctxCache   ContextCache
+	metrics    metrics
+	writesOnce sync.Once
+	writes     *writeQueue
+	// refreshing holds the keys being refreshed early
+	refreshing sync.Map
 }
 
 // NewMiddleware retrieves an instance of Cache handler
 func NewMiddleware(cache Cache) *Middleware {
 	return &Middleware{
-		cache:  cache,
-		Shared: false,
+		cache:    cache,
+		ctxCache: AsContextCache(cache),
+		Shared:   false,
 	}
 }
 
+// Purge removes the entries stored for the keys from the cache, either by
+// invalidating them or by erasing them
+func (ch *Middleware) Purge(mode PurgeMode, keys ...string) error {
+	if mode == HardPurge {
+		return ch.cache.Delete(keys...)
+	}
+	ch.cache.Invalidate(keys...)
+	return nil
+}
+
+// CacheStats reports the statistics of the middleware, along with the
+// evictions and size of its cache if it reports them
+func (ch *Middleware) CacheStats() Stats {
+	s := ch.metrics.snapshot()
+	if r, ok := ch.cache.(StatsReporter); ok {
+		inner := r.CacheStats()
+		s.Evictions, s.Entries, s.Bytes = inner.Evictions, inner.Entries, inner.Bytes
+	}
+	return s
+}
+
+// writeQueue returns the queue of background writes, started on first use
+// so that the write settings can be changed after NewMiddleware
+func (ch *Middleware) writeQueue() *writeQueue {
+	ch.writesOnce.Do(func() {
+		ch.writes = newWriteQueue(ch.WriteWorkers, ch.WriteQueue, ch.WriteDropPolicy,
+			&ch.metrics, ch.store)
+	})
+	return ch.writes
+}
+
+// Close stops storing responses and waits for the pending writes. Once ctx
+// is done, queued writes are dropped, running ones are cancelled and the
+// error of ctx is returned.
+func (ch *Middleware) Close(ctx context.Context) error {
+	return ch.writeQueue().close(ctx)
+}
+
+// logDecision logs how the middleware handled a request
+func (ch *Middleware) logDecision(r *CacheRequest, decision string, args ...any) {
+	logDebug(ch.Logger, "cache decision", append([]any{
+		"method", r.Method,
+		"key", r.Key.String(),
+		"decision", decision,
+		"shared", ch.Shared,
+	}, args...)...)
+}
+
+// Handler wraps next with the cache as a standard net/http middleware,
+// which can be passed directly to routers such as chi and gorilla/mux
+func (ch *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ch.ServeHTTP(rw, r, next.ServeHTTP)
+	})
+}
+
 func (ch *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	ctx, span := ch.tracer().Start(r.Context(), "negronicache.ServeHTTP")
+	defer span.End()
+	r = r.WithContext(ctx)
+
 	cReq, err := NewCacheRequest(r)
 	if err != nil {
 		http.Error(rw, "invalid request: "+err.Error(),
 			http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(keyHash(cReq.Key.String()))
+	if ch.explaining(r) {
+		cReq.explain = &explainer{}
+		cReq.explain.add("key %s", cReq.Key)
+	}
 
-	if !cReq.isCacheable() {
-		debugf("request not cacheable")
+	if reason := cReq.uncacheableReason(); reason != "" {
+		cReq.explain.add("request not cacheable: %s", reason)
+		ch.logDecision(cReq, "skip", "reason", BypassRequest)
+		ch.metrics.bypass(BypassRequest)
+		span.SetAttributes(attrResult.String("skip"))
 		rw.Header().Set(CacheHeader, "SKIP")
 		ch.UpstreamWithCache(rw, cReq, next)
 		return
 	}
 
-	res, err := ch.LookupInCached(cReq)
-	if err != nil && err != ErrNotFoundInCache {
-		http.Error(rw, "lookup error: "+err.Error(),
-			http.StatusInternalServerError)
+	if ch.Admission != nil {
+		ch.Admission.Record(cReq.Key.String())
+	}
+
+	if !ch.Breaker.Allow() {
+		ch.logDecision(cReq, "skip", "reason", BypassCircuitOpen)
+		ch.metrics.bypass(BypassCircuitOpen)
+		span.SetAttributes(attrResult.String("skip"))
+		cReq.explain.add("cache backend circuit open")
+		ch.UpstreamWithCache(rw, cReq, next)
 		return
 	}
 
-	cacheType := "private"
-	if ch.Shared {
-		cacheType = "shared"
+	t := time.Now()
+	res, err := ch.LookupInCached(cReq)
+	ch.metrics.lookup.observe(time.Since(t))
+	if err != nil && err != ErrNotFoundInCache {
+		ch.lookupFailed(rw, cReq, next, err)
+		return
 	}
+	ch.Breaker.Success()
 
 	if err == ErrNotFoundInCache {
+		ch.metrics.add(&ch.metrics.misses, 1)
+		span.SetAttributes(attrResult.String("miss"))
+		cReq.explain.add("not in cache")
 		if cReq.CacheControl.Has("only-if-cached") {
+			cReq.explain.add("only-if-cached, not fetched")
+			setExplanation(rw.Header(), cReq)
 			http.Error(rw, "key not in cache",
 				http.StatusGatewayTimeout)
 			return
 		}
-		debugf("%s %s not in %s cache", r.Method, r.URL.String(), cacheType)
+		ch.logDecision(cReq, "miss")
 		ch.UpstreamWithCache(rw, cReq, next)
 		return
 	}
 
-	debugf("%s %s found in %s cache", r.Method, r.URL.String(), cacheType)
+	cReq.explain.add("found in cache")
+	explainFreshness(res, cReq, ch.Shared)
+
+	if validated, resp := ch.revalidate(res, cReq, next); !validated {
+		ch.logDecision(cReq, "miss", "reason", "changed")
+		ch.metrics.add(&ch.metrics.misses, 1)
+		span.SetAttributes(attrResult.String("miss"))
+		res.Close()
+		ch.serveRecorded(rw, cReq, resp)
+		return
+	}
 
+	ch.logDecision(cReq, "hit", "status", res.Status())
+	ch.metrics.add(&ch.metrics.hits, 1)
+	span.SetAttributes(attrResult.String("hit"))
+	if ch.refreshEarly(res, cReq) {
+		cReq.explain.add("refreshing early")
+		ch.refresh(cReq, next)
+	}
 	res.Header().Set(CacheHeader, "HIT")
+	setExplanation(rw.Header(), cReq)
 	ch.ServeResource(res, rw, cReq)
 
 	if err := res.Close(); err != nil {
-		errorf("Error closing resource: %s", err.Error())
+		logError(ch.Logger, "closing resource failed", err, "key", cReq.Key.String())
+	}
+}
+
+// lookupFailed handles a request whose lookup failed, passing it upstream
+// unless the ErrorHandler is set
+func (ch *Middleware) lookupFailed(rw http.ResponseWriter, r *CacheRequest, next http.HandlerFunc, err error) {
+	span := trace.SpanFromContext(r.Context())
+	recordError(span, err)
+	span.SetAttributes(attrResult.String("skip"))
+
+	if r.Context().Err() != nil {
+		// the client went away, which says nothing about the backend
+		return
+	}
+	if ch.Breaker.Failure() {
+		logWarn(ch.Logger, "cache backend circuit opened", "error", err)
+	}
+
+	reason := BypassLookupError
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = BypassLookupTimeout
+		r.explain.add("lookup timed out after %s", ch.LookupTimeout)
+	} else {
+		logError(ch.Logger, "lookup failed", err, "key", r.Key.String())
+		r.explain.add("lookup failed: %s", err)
+	}
+	ch.metrics.bypass(reason)
+
+	if ch.ErrorHandler != nil {
+		setExplanation(rw.Header(), r)
+		ch.ErrorHandler(rw, r.Request, err)
+		return
+	}
+	ch.logDecision(r, "skip", "reason", reason)
+	ch.UpstreamWithCache(rw, r, next)
+}
+
+// revalidate validates a stale resource that carries validators against
+// the next handler, freshening the cache if it is still valid. Otherwise
+// it returns false along with the response of the next handler.
+func (ch *Middleware) revalidate(res *Resource, r *CacheRequest, next http.Handler) (bool, *httptest.ResponseRecorder) {
+	if fresh, err := ch.Freshness(res, r); err == nil && fresh > 0 {
+		return true, nil
+	}
+
+	if !res.HasValidators() || r.CacheControl.Has("only-if-cached") {
+		if !res.HasValidators() {
+			r.explain.add("served stale, no validators")
+		} else {
+			r.explain.add("served stale, only-if-cached")
+		}
+		ch.metrics.add(&ch.metrics.staleHits, 1)
+		return true, nil
+	}
+
+	ctx, span := ch.tracer().Start(r.Context(), "negronicache.revalidate",
+		trace.WithAttributes(keyHash(r.Key.String())))
+	defer span.End()
+
+	validator := &Validator{Handler: next}
+	validated, resp := validator.validate(r.Request.WithContext(ctx), res)
+	if !validated {
+		logDebug(ch.Logger, "validation failed", "key", r.Key.String(), "status", resp.Code)
+		r.explain.add("revalidation failed, status %d", resp.Code)
+		span.SetAttributes(attrValidated.Bool(false))
+		return false, resp
+	}
+	span.SetAttributes(attrValidated.Bool(true))
+
+	logDebug(ch.Logger, "validated", "key", r.Key.String())
+	ch.applyTTL(res, r)
+	r.explain.add("revalidated")
+	ch.metrics.add(&ch.metrics.revalidations, 1)
+	if err := ch.ctxCache.FreshenContext(ctx, res, storeKeys(res, r)...); err != nil {
+		recordError(span, err)
+		logError(ch.Logger, "freshening failed", err, "key", r.Key.String())
+	}
+	return true, nil
+}
+
+// serveRecorded serves the response the next handler gave to a failed
+// revalidation, and stores it if it is cacheable, rather than calling the
+// next handler again
+func (ch *Middleware) serveRecorded(rw http.ResponseWriter, r *CacheRequest, resp *httptest.ResponseRecorder) {
+	body := resp.Body.Bytes()
+	res := NewResourceBytes(resp.Code, body, cloneHeader(resp.Header()))
+	res.RequestTime = r.Time
+	res.ResponseTime = Clock()
+
+	for key, headers := range resp.Header() {
+		for _, header := range headers {
+			rw.Header().Add(key, header)
+		}
+	}
+	rw.Header().Del(TTLHeader)
+	if ch.TTLOverrideHeader != "" {
+		rw.Header().Del(ch.TTLOverrideHeader)
+	}
+	rw.Header().Set(CacheHeader, "SKIP")
+
+	reason := ch.uncacheableReason(res, r)
+	if reason != "" {
+		r.explain.add("response not cacheable: %s", reason)
+	} else {
+		r.explain.add("response cacheable, storing as %s", strings.Join(storeKeys(res, r), ", "))
+	}
+	setExplanation(rw.Header(), r)
+	rw.WriteHeader(resp.Code)
+	rw.Write(body)
+
+	if reason != "" {
+		ch.logDecision(r, "skip", "reason", BypassResponse, "status", res.Status())
+		ch.metrics.bypass(BypassResponse)
+		return
 	}
+	res.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	ch.applyTTL(res, r)
+	ch.CacheResource(res, r)
 }
 
 // ServeResource is used for wrapping the ResponseWriter and returning the request.
@@ -114,29 +412,14 @@ func (ch *Middleware) ServeResource(res *Resource, rw http.ResponseWriter, req *
 			rw.Header().Add(key, header)
 		}
 	}
+	rw.Header().Del(TTLHeader)
 
-	age, err := res.Age()
-	if err != nil {
+	if err := setCachedHeaders(rw.Header(), res, req, ch.Shared); err != nil {
 		http.Error(rw, "Error calculating age: "+err.Error(),
 			http.StatusInternalServerError)
 		return
 	}
 
-	if age > (time.Hour*24) && res.HeuristicFreshness() > (time.Hour*24) {
-		rw.Header().Add("Warning", `113 - "Heuristic Expiration"`)
-	}
-
-	freshness, err := ch.Freshness(res, req)
-	if err != nil || freshness <= 0 {
-		rw.Header().Add("Warning", `110 - "Response is Stale"`)
-	}
-
-	debugf("resource is %s old, updating age from %s",
-		age.String(), rw.Header().Get("Age"))
-
-	rw.Header().Set("Age", fmt.Sprintf("%.f", math.Floor(age.Seconds())))
-	rw.Header().Set("Via", res.Via())
-
 	// hacky handler for non-ok statuses
 	if res.Status() != http.StatusOK {
 		rw.WriteHeader(res.Status())
@@ -146,28 +429,95 @@ func (ch *Middleware) ServeResource(res *Resource, rw http.ResponseWriter, req *
 	}
 }
 
+// setCachedHeaders sets the Age, Via and Warning headers of a response
+// served from the cache
+func setCachedHeaders(h http.Header, res *Resource, req *CacheRequest, shared bool) error {
+	age, err := res.Age()
+	if err != nil {
+		return err
+	}
+
+	if age > (time.Hour*24) && res.HeuristicFreshness() > (time.Hour*24) {
+		h.Add("Warning", `113 - "Heuristic Expiration"`)
+	}
+
+	fresh, err := freshness(res, req, shared)
+	if err != nil || fresh <= 0 {
+		h.Add("Warning", `110 - "Response is Stale"`)
+	}
+
+	logDebug(nil, "updating age", "age", age, "previous", h.Get("Age"))
+
+	h.Set("Age", fmt.Sprintf("%.f", math.Floor(age.Seconds())))
+	h.Set("Via", res.Via())
+	return nil
+}
+
 // UpstreamWithCache returns the request to a specific handler and stores the result
 func (ch *Middleware) UpstreamWithCache(rw http.ResponseWriter, r *CacheRequest, next http.HandlerFunc) {
-	rs := NewResponseStreamer(rw)
+	ctx, span := ch.tracer().Start(r.Context(), "negronicache.upstream",
+		trace.WithAttributes(keyHash(r.Key.String())))
+	defer span.End()
+
+	w := rw
+	var tw *ttlWriter
+	if ch.TTLOverrideHeader != "" {
+		tw = &ttlWriter{ResponseWriter: w, header: ch.TTLOverrideHeader}
+		w = tw
+	}
+	var ew *explainWriter
+	if r.explain != nil {
+		ew = &explainWriter{ResponseWriter: w, ch: ch, r: r}
+		w = ew
+	}
+
+	rs := NewResponseStreamer(w)
 	rdr, err := rs.Stream.NextReader()
 	if err != nil {
-		debugf("error creating next stream reader: %v", err)
+		logError(ch.Logger, "creating stream reader failed", err, "key", r.Key.String())
 		rw.Header().Set(CacheHeader, "SKIP")
-		next(rw, r.Request)
+		next(rw, r.Request.WithContext(ctx))
 		return
 	}
 
 	t := Clock()
 	rw.Header().Set(CacheHeader, "SKIP")
 
-	next(rs, r.Request)
+	next(rs, r.Request.WithContext(ctx))
 	rs.Stream.Close()
+	if rs.StatusCode == 0 {
+		// like net/http, a handler writing nothing responds 200 OK
+		rs.StatusCode = http.StatusOK
+	}
+	span.SetAttributes(attrStatus.Int(rs.StatusCode))
+
+	h := rs.Header()
+	if ew != nil {
+		// the headers are only written once the handler returns
+		ew.explain(http.StatusOK)
+		// the explanation belongs to this response only
+		h = cloneHeader(h)
+		h.Del(DebugResponseHeader)
+	}
+	if tw != nil {
+		// the override is only kept for storing the response
+		tw.strip()
+		if tw.value != "" {
+			h = cloneHeader(h)
+			h.Set(ch.TTLOverrideHeader, tw.value)
+		}
+	}
 
 	// Just the headers
-	res := NewResourceBytes(rs.StatusCode, nil, rs.Header())
+	res := NewResourceBytes(rs.StatusCode, nil, h)
+	res.RequestTime = t
+	res.ResponseTime = Clock()
 	if !ch.isCacheable(res, r) {
 		rdr.Close()
-		debugf("resource is uncacheable")
+		ch.logDecision(r, "skip", "reason", BypassResponse, "status", res.Status())
+		if r.isCacheable() {
+			ch.metrics.bypass(BypassResponse)
+		}
 		rs.Header().Set(CacheHeader, "SKIP")
 		return
 	}
@@ -175,64 +525,129 @@ func (ch *Middleware) UpstreamWithCache(rw http.ResponseWriter, r *CacheRequest,
 	b, err := ioutil.ReadAll(rdr)
 	rdr.Close()
 	if err != nil {
-		debugf("error reading stream: %v", err)
+		logError(ch.Logger, "reading stream failed", err, "key", r.Key.String())
 		rs.Header().Set(CacheHeader, "SKIP")
 		return
 	}
-	debugf("full upstream response took %s", Clock().Sub(t).String())
+	logDebug(ch.Logger, "upstream response", "key", r.Key.String(), "status", res.Status(),
+		"duration", Clock().Sub(t))
+	span.SetAttributes(attrBytes.Int(len(b)))
 	res.ReadSeekCloser = &ByteReadSeekCloser{bytes.NewReader(b)}
 
 	// if age, err := CorrectedAge(res.Header(), t, Clock()); err == nil {
 	//     res.Header().Set("Age", strconv.Itoa(int(math.Ceil(age.Seconds()))))
 	// } else {
-	//     debugf("error calculating corrected age: %s", err.Error())
+	//     logDebug(nil, "calculating corrected age failed", "error", err)
 	// }
 
-	rs.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	res.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	ch.applyTTL(res, r)
 	// Cache the http response
 	ch.CacheResource(res, r)
 }
 
-// CacheResource can store the response in the cache.
+// CacheResource can store the response in the cache. The response is
+// queued and stored in the background.
 func (ch *Middleware) CacheResource(res *Resource, r *CacheRequest) {
-	Writes.Add(1)
+	if ch.Breaker.Open() {
+		logDebug(ch.Logger, "not storing, cache backend circuit open", "key", r.Key.String())
+		return
+	}
+	if ch.Admission != nil && !ch.Admission.Admit(r.Key.String()) {
+		logDebug(ch.Logger, "not storing, not admitted", "key", r.Key.String())
+		ch.metrics.bypass(BypassAdmission)
+		return
+	}
+	if !ch.writeQueue().push(&write{res: res, r: r, key: r.Key.String()}) {
+		logDebug(ch.Logger, "not storing, write dropped", "key", r.Key.String())
+	}
+}
 
-	go func() {
-		defer Writes.Done()
-		t := Clock()
-		keys := []string{r.Key.String()}
-		headers := res.Header()
+// store stores a queued response, in a worker of the write queue
+func (ch *Middleware) store(ctx context.Context, w *write) {
+	res, r := w.res, w.r
+	ctx, span := ch.tracer().Start(ctx, "negronicache.store",
+		trace.WithAttributes(keyHash(r.Key.String())))
+	defer span.End()
+	t := Clock()
 
-		if ch.Shared {
-			res.RemovePrivateHeaders()
-		}
+	if ch.Shared {
+		res.RemovePrivateHeaders()
+	}
 
-		// store a secondary vary version
-		if vary := headers.Get("Vary"); vary != "" {
-			keys = append(keys, r.Key.Vary(vary, r.Request).String())
-		}
+	size, _ := res.Seek(0, io.SeekEnd)
+	res.Seek(0, io.SeekStart)
 
-		if err := ch.cache.Store(res, keys...); err != nil {
-			errorf("storing resources %#v failed with error: %s", keys, err.Error())
-		}
+	keys := storeKeys(res, r)
+	start := time.Now()
+	err := ch.ctxCache.StoreContext(ctx, res, keys...)
+	ch.metrics.store.observe(time.Since(start))
+	span.SetAttributes(attrBytes.Int64(size))
+	if err != nil {
+		recordError(span, err)
+		ch.metrics.add(&ch.metrics.storeFailures, 1)
+		logError(ch.Logger, "storing failed", err, "keys", keys)
+	} else {
+		ch.metrics.add(&ch.metrics.stores, 1)
+		ch.metrics.add(&ch.metrics.storedBytes, size)
+	}
+
+	logDebug(ch.Logger, "stored", "keys", keys, "status", res.Status(), "bytes", size,
+		"duration", Clock().Sub(t))
+}
 
-		debugf("stored resources %+v in %s", keys, Clock().Sub(t))
-	}()
+// storeKeys returns the keys a resource is stored against, including
+// a secondary vary version if the resource has a Vary header
+func storeKeys(res *Resource, r *CacheRequest) []string {
+	keys := []string{r.Key.String()}
+
+	if vary := res.Header().Get("Vary"); vary != "" {
+		keys = append(keys, r.Key.Vary(vary, r.Request).String())
+	}
+
+	return keys
 }
 
 // LookupInCached finds the best matching Resource for the
-// request, or nil and ErrNotFoundInCache if none is found
+// request, or nil and ErrNotFoundInCache if none is found. The lookup is
+// bounded by the request context and the LookupTimeout.
 func (ch *Middleware) LookupInCached(req *CacheRequest) (*Resource, error) {
-	res, err := ch.cache.Retrieve(req.Key.String())
+	ctx, span := ch.tracer().Start(req.Context(), "negronicache.lookup",
+		trace.WithAttributes(keyHash(req.Key.String())))
+	defer span.End()
+
+	if ch.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ch.LookupTimeout)
+		defer cancel()
+	}
+
+	res, err := lookup(ctx, ch.ctxCache, req)
+	switch {
+	case err == ErrNotFoundInCache:
+		span.SetAttributes(attrHit.Bool(false))
+	case err != nil:
+		recordError(span, err)
+	default:
+		span.SetAttributes(attrHit.Bool(true))
+		if fresh, err := ch.Freshness(res, req); err == nil {
+			span.SetAttributes(attrFreshness.Float64(fresh.Seconds()))
+		}
+	}
+	return res, err
+}
+
+func lookup(ctx context.Context, c ContextCache, req *CacheRequest) (*Resource, error) {
+	res, err := c.RetrieveContext(ctx, req.Key.String())
 	// HEAD requests can possibly be served from GET
 	if err == ErrNotFoundInCache && req.Method == "HEAD" {
-		res, err = ch.cache.Retrieve(req.Key.ForMethod("GET").String())
+		res, err = c.RetrieveContext(ctx, req.Key.ForMethod("GET").String())
 		if err != nil {
 			return nil, err
 		}
 
 		if res.HasExplicitExpiration() && req.isCacheable() {
-			debugf("using cached GET request for serving HEAD")
+			logDebug(nil, "serving HEAD from cached GET", "key", req.Key.String())
 			return res, nil
 		}
 
@@ -243,9 +658,9 @@ func (ch *Middleware) LookupInCached(req *CacheRequest) (*Resource, error) {
 
 	// Secondary lookup for Vary
 	// if vary := res.Header().Get("Vary"); vary != "" {
-	//     debugf("Original retrieved key: %s", req.Key.String())
-	//     debugf("Varied : %s", req.Key.Vary(vary, req.Request).String())
-	// 	res, err = ch.cache.Retrieve(req.Key.Vary(vary, req.Request).String())
+	//     logDebug(nil, "original retrieved key", "key", req.Key.String())
+	//     logDebug(nil, "varied", "key", req.Key.Vary(vary, req.Request).String())
+	// 	res, err = c.Retrieve(req.Key.Vary(vary, req.Request).String())
 	// 	if err != nil {
 	// 		return res, err
 	// 	}
@@ -254,9 +669,14 @@ func (ch *Middleware) LookupInCached(req *CacheRequest) (*Resource, error) {
 	return res, nil
 }
 
-// Freshness returns the duration that a requested resource will be fresh for
+// Freshness returns the duration that a requested resource will be fresh
+// for
 func (ch *Middleware) Freshness(res *Resource, r *CacheRequest) (time.Duration, error) {
-	maxAge, err := res.MaxAge(ch.Shared)
+	return freshness(res, r, ch.Shared)
+}
+
+func freshness(res *Resource, r *CacheRequest, shared bool) (time.Duration, error) {
+	maxAge, err := res.MaxAge(shared)
 	if err != nil {
 		return time.Duration(0), err
 	}
@@ -268,7 +688,7 @@ func (ch *Middleware) Freshness(res *Resource, r *CacheRequest) (time.Duration,
 		}
 
 		if reqMaxAge < maxAge {
-			debugf("using request max-age of %s", reqMaxAge.String())
+			logDebug(nil, "using request max-age", "max_age", reqMaxAge)
 			maxAge = reqMaxAge
 		}
 	}
@@ -283,7 +703,7 @@ func (ch *Middleware) Freshness(res *Resource, r *CacheRequest) (time.Duration,
 	}
 
 	if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
-		debugf("using heuristic freshness of %q", hFresh)
+		logDebug(nil, "using heuristic freshness", "freshness", hFresh)
 		maxAge = hFresh
 	}
 
@@ -291,47 +711,69 @@ func (ch *Middleware) Freshness(res *Resource, r *CacheRequest) (time.Duration,
 }
 
 func (ch *Middleware) isCacheable(res *Resource, r *CacheRequest) bool {
+	return ch.uncacheableReason(res, r) == ""
+}
+
+// uncacheableReason explains why the response can't be stored by the
+// middleware, or returns "" if it can
+func (ch *Middleware) uncacheableReason(res *Resource, r *CacheRequest) string {
+	if ch.TTLOverrideHeader != "" &&
+		strings.TrimSpace(res.Header().Get(ch.TTLOverrideHeader)) == "0" {
+		return ch.TTLOverrideHeader + " 0"
+	}
+	return uncacheableResourceReason(res, r, ch.Shared)
+}
+
+func isCacheableResource(res *Resource, r *CacheRequest, shared bool) bool {
+	return uncacheableResourceReason(res, r, shared) == ""
+}
+
+// uncacheableResourceReason explains why the response can't be stored, or
+// returns "" if it can
+func uncacheableResourceReason(res *Resource, r *CacheRequest, shared bool) string {
 	cc, err := res.cacheControl()
 	if err != nil {
-		errorf("Error parsing cache-control: %s", err.Error())
-		return false
+		logWarn(nil, "parsing Cache-Control failed", "error", err)
+		return "invalid Cache-Control: " + err.Error()
 	}
 
-	if cc.Has("no-cache") || cc.Has("no-store") {
-		return false
+	for _, directive := range []string{"no-cache", "no-store"} {
+		if cc.Has(directive) {
+			return "response Cache-Control " + directive
+		}
 	}
 
-	if cc.Has("private") && len(cc["private"]) == 0 && ch.Shared {
-		return false
+	if cc.Has("private") && len(cc["private"]) == 0 && shared {
+		return "response Cache-Control private in a shared cache"
 	}
 
 	if _, ok := storeable[res.Status()]; !ok {
-		return false
+		return fmt.Sprintf("status %d not storeable", res.Status())
 	}
 
-	if r.Header.Get("Authorization") != "" && ch.Shared {
-		return false
+	if r.Header.Get("Authorization") != "" && shared {
+		return "authorized request in a shared cache"
 	}
 
-	if res.Header().Get("Authorization") != "" && ch.Shared &&
+	if res.Header().Get("Authorization") != "" && shared &&
 		!cc.Has("must-revalidate") && !cc.Has("s-maxage") {
-		return false
+		return "authorized response in a shared cache without must-revalidate or s-maxage"
 	}
 
 	if res.HasExplicitExpiration() {
-		return true
+		return ""
 	}
 
 	if _, ok := cacheableByDefault[res.Status()]; !ok && !cc.Has("public") {
-		return false
+		return fmt.Sprintf("status %d not cacheable by default and no explicit expiration", res.Status())
 	}
 
 	// if res.HasValidators() {
-	// 	return true
+	// 	return ""
 	// } else if res.HeuristicFreshness() > 0 {
-	// 	return true
+	// 	return ""
 	// }
-	return true
+	return ""
 }
 
 // CorrectedAge adjusts the age of a resource for clock skew and travel time
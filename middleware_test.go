@@ -1,6 +1,8 @@
 package negronicache
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -44,3 +46,108 @@ func TestMiddleware_ServeHTTP(t *testing.T) {
 	assert.Equal(t, recCache.Status(), 200)
 	assert.Equal(t, recCache.Header().Get(CacheHeader), "HIT")
 }
+
+func TestMiddleware_Handler(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.WriteHeader(200)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/handler", nil))
+	assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+	Writes.Wait()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/handler", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+}
+
+func TestMiddleware_Revalidate(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	calls, notModified := 0, 0
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.Header().Set("X-Revalidated", "1")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept")
+		w.Write([]byte("validated body"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/revalidate", nil))
+	Writes.Wait()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/revalidate", nil))
+	Writes.Wait()
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+	assert.Equal(t, "validated body", rec.Body.String())
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 1, notModified)
+
+	// the headers of the 304 are merged into the stored ones
+	assert.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+	assert.Equal(t, "1", rec.Header().Get("X-Revalidated"))
+	stored, err := mw.cache.Header("GET:http://example.com/revalidate")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain", stored.Get("Content-Type"))
+	assert.Equal(t, "1", stored.Get("X-Revalidated"))
+}
+
+func TestMiddleware_RevalidateChanged(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	calls := 0
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=0")
+		if calls == 1 {
+			w.Header().Set("ETag", `"v1"`)
+		}
+		// a full response without validators doesn't validate the entry
+		fmt.Fprintf(w, "body %d", calls)
+	}))
+
+	for i := 1; i <= 2; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/changed", nil))
+		Writes.Wait()
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+		assert.Equal(t, fmt.Sprintf("body %d", i), rec.Body.String())
+		assert.Equal(t, i, calls, "the upstream is called once per request")
+	}
+
+	// the response to the failed revalidation replaced the entry
+	res, err := mw.cache.Retrieve("GET:http://example.com/changed")
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body 2", string(b))
+	assert.Empty(t, res.Header().Get("ETag"))
+}
+
+func TestMiddleware_Purge(t *testing.T) {
+	c := NewMemoryCache()
+	mw := NewMiddleware(c)
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), make(http.Header)), testKey))
+
+	assert.Nil(t, mw.Purge(SoftPurge, testKey))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	assert.Nil(t, mw.Purge(HardPurge, testKey))
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+}
@@ -0,0 +1,96 @@
+package negronicache
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize is the largest UDP payload
+const maxDatagramSize = 65507
+
+// ErrInvalidationTooLarge is returned when an invalidation doesn't fit in a
+// single datagram
+var ErrInvalidationTooLarge = errors.New("invalidation too large for a datagram")
+
+// MulticastBus is an InvalidationBus sending JSON encoded invalidations to a
+// UDP multicast group, for instances on the same network segment. Delivery
+// is unreliable.
+type MulticastBus struct {
+	in, out *net.UDPConn
+
+	mu   sync.RWMutex
+	subs []func(Invalidation)
+}
+
+var _ InvalidationBus = (*MulticastBus)(nil)
+
+// NewMulticastBus joins the multicast group at addr, e.g. "239.0.0.1:7946",
+// on the given interface or the system default if nil
+func NewMulticastBus(addr string, ifi *net.Interface) (*MulticastBus, error) {
+	group, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	in, err := net.ListenMulticastUDP("udp", ifi, group)
+	if err != nil {
+		return nil, err
+	}
+	out, err := net.DialUDP("udp", nil, group)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+
+	b := &MulticastBus{in: in, out: out}
+	go b.receive()
+	return b, nil
+}
+
+func (b *MulticastBus) receive() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, _, err := b.in.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		var inv Invalidation
+		if err := json.Unmarshal(buf[:n], &inv); err != nil {
+			logWarn(nil, "dropping malformed invalidation", "error", err)
+			continue
+		}
+
+		b.mu.RLock()
+		subs := b.subs
+		b.mu.RUnlock()
+		for _, fn := range subs {
+			fn(inv)
+		}
+	}
+}
+
+func (b *MulticastBus) Publish(inv Invalidation) error {
+	msg, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if len(msg) > maxDatagramSize {
+		return ErrInvalidationTooLarge
+	}
+	_, err = b.out.Write(msg)
+	return err
+}
+
+func (b *MulticastBus) Subscribe(fn func(Invalidation)) error {
+	b.mu.Lock()
+	b.subs = append(b.subs, fn)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *MulticastBus) Close() error {
+	b.out.Close()
+	return b.in.Close()
+}
@@ -0,0 +1,444 @@
+package negronicache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultPeerReplicas = 50
+	defaultPeerBasePath = "/_negronicache/"
+	// peerStaleHeader flags entries served by a peer as stale
+	peerStaleHeader = "X-Negronicache-Stale"
+)
+
+// PeerOptions configures a PeerCache
+type PeerOptions struct {
+	// BasePath is the path the peer protocol is served under,
+	// "/_negronicache/" by default
+	BasePath string
+	// Replicas is the number of points each peer has on the hash ring, 50 by
+	// default
+	Replicas int
+	// Hot optionally keeps the entries fetched from other peers locally.
+	// Invalidations only reach the hot cache of the instance they are made
+	// on, so it should be small and bounded.
+	Hot Cache
+	// Client is used to reach the other peers, http.DefaultClient if nil
+	Client *http.Client
+}
+
+// PeerCache shards entries across a set of peers with consistent hashing of
+// their keys. Each instance stores the keys it owns in its local cache and
+// forwards the others to their owner, serving its own shard to the other
+// peers through ServeHTTP.
+type PeerCache struct {
+	self   string
+	local  Cache
+	opts   PeerOptions
+	logger *slog.Logger
+
+	mu    sync.RWMutex
+	ring  []uint64
+	owner map[uint64]string
+}
+
+var (
+	_ Cache        = (*PeerCache)(nil)
+	_ Loggable     = (*PeerCache)(nil)
+	_ http.Handler = (*PeerCache)(nil)
+)
+
+// NewPeerCache returns a cache for the peer reachable at the base URL self,
+// e.g. "http://10.0.0.1:8080", storing its shard in local
+func NewPeerCache(self string, local Cache, opts PeerOptions) *PeerCache {
+	if opts.BasePath == "" {
+		opts.BasePath = defaultPeerBasePath
+	}
+	if opts.Replicas <= 0 {
+		opts.Replicas = defaultPeerReplicas
+	}
+	p := &PeerCache{self: self, local: local, opts: opts}
+	p.SetPeers()
+	return p
+}
+
+// SetLogger sets the logger reporting failures to reach the other peers
+func (p *PeerCache) SetLogger(l *slog.Logger) {
+	p.logger = l
+}
+
+// SetPeers replaces the set of peers, given by their base URL. The instance
+// itself is always part of the set. It can be called at any time, keys
+// moving to another peer are missed until they are stored again.
+func (p *PeerCache) SetPeers(peers ...string) {
+	ring := []uint64{}
+	owner := map[uint64]string{}
+	for _, peer := range append([]string{p.self}, peers...) {
+		for i := 0; i < p.opts.Replicas; i++ {
+			point := ringPoint(peer + "#" + strconv.Itoa(i))
+			if _, ok := owner[point]; !ok {
+				ring = append(ring, point)
+			}
+			owner[point] = peer
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+
+	p.mu.Lock()
+	p.ring, p.owner = ring, owner
+	p.mu.Unlock()
+}
+
+// ringPoint places a string on the hash ring
+func ringPoint(s string) uint64 {
+	point, _ := strconv.ParseUint(hashKey(s)[:16], 16, 64)
+	return point
+}
+
+// routingKey strips the Vary part of a key, so that the variants of an
+// entry are owned by the peer owning the entry
+func routingKey(key string) string {
+	if i := strings.Index(key, "::"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// Owner returns the base URL of the peer owning the key, the same for all
+// the Vary variants of an entry
+func (p *PeerCache) Owner(key string) string {
+	point := ringPoint(routingKey(key))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= point })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.owner[p.ring[i]]
+}
+
+// shards groups keys by the peer owning them
+func (p *PeerCache) shards(keys []string) map[string][]string {
+	shards := map[string][]string{}
+	for _, key := range keys {
+		owner := p.Owner(key)
+		shards[owner] = append(shards[owner], key)
+	}
+	return shards
+}
+
+func (p *PeerCache) Header(key string) (Header, error) {
+	if owner := p.Owner(key); owner != p.self {
+		e, _, err := p.fetch(owner, key, "meta")
+		if err != nil {
+			return Header{}, err
+		}
+		return Header{StatusCode: e.StatusCode, Header: e.Header}, nil
+	}
+	return p.local.Header(key)
+}
+
+func (p *PeerCache) Stat(key string) (EntryInfo, error) {
+	if owner := p.Owner(key); owner != p.self {
+		e, _, err := p.fetch(owner, key, "meta")
+		if err != nil {
+			return EntryInfo{}, err
+		}
+		return e.EntryInfo, nil
+	}
+	return p.local.Stat(key)
+}
+
+// Store stores the entry with all its keys on the owner of the primary key,
+// the first one, which owns its variants as well
+func (p *PeerCache) Store(res *Resource, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	e, err := NewEntry(res, "")
+	if err != nil {
+		return err
+	}
+
+	if owner := p.Owner(keys[0]); owner == p.self {
+		return p.local.Store(e.Resource(), keys...)
+	} else if err := p.send(owner, "PUT", "store", keys, e); err != nil {
+		return err
+	}
+	if p.opts.Hot != nil {
+		return p.opts.Hot.Store(e.Resource(), keys...)
+	}
+	return nil
+}
+
+func (p *PeerCache) Retrieve(key string) (*Resource, error) {
+	owner := p.Owner(key)
+	if owner == p.self {
+		return p.local.Retrieve(key)
+	}
+
+	if p.opts.Hot != nil {
+		if res, err := p.opts.Hot.Retrieve(key); err == nil {
+			return res, nil
+		}
+	}
+
+	e, stale, err := p.fetch(owner, key, "")
+	if err != nil {
+		return nil, err
+	}
+	if p.opts.Hot != nil {
+		if err := p.opts.Hot.Store(e.Resource(), key); err != nil {
+			logError(p.logger, "storing in the hot cache failed", err, "key", key)
+		} else if stale {
+			p.opts.Hot.Invalidate(key)
+		}
+	}
+
+	res := e.Resource()
+	if stale {
+		res.MarkStale()
+	}
+	return res, nil
+}
+
+func (p *PeerCache) Invalidate(keys ...string) {
+	if p.opts.Hot != nil {
+		p.opts.Hot.Invalidate(keys...)
+	}
+	for owner, keys := range p.shards(keys) {
+		if owner == p.self {
+			p.local.Invalidate(keys...)
+		} else if err := p.send(owner, "POST", "invalidate", keys, nil); err != nil {
+			logError(p.logger, "invalidating on peer failed", err, "keys", keys, "peer", owner)
+		}
+	}
+}
+
+func (p *PeerCache) Delete(keys ...string) error {
+	if p.opts.Hot != nil {
+		if err := p.opts.Hot.Delete(keys...); err != nil {
+			return err
+		}
+	}
+	for owner, keys := range p.shards(keys) {
+		var err error
+		if owner == p.self {
+			err = p.local.Delete(keys...)
+		} else {
+			err = p.send(owner, "DELETE", "delete", keys, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PeerCache) Freshen(res *Resource, keys ...string) error {
+	if p.opts.Hot != nil {
+		if err := p.opts.Hot.Freshen(res, keys...); err != nil {
+			return err
+		}
+	}
+
+	// only the headers of the validated resource are sent
+	e := &Entry{StatusCode: res.Status(), Header: res.Header()}
+	e.RequestTime, e.ResponseTime = res.RequestTime, res.ResponseTime
+	for owner, keys := range p.shards(keys) {
+		var err error
+		if owner == p.self {
+			err = p.local.Freshen(res, keys...)
+		} else {
+			err = p.send(owner, "POST", "freshen", keys, e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PeerCache) client() *http.Client {
+	if p.opts.Client != nil {
+		return p.opts.Client
+	}
+	return http.DefaultClient
+}
+
+func (p *PeerCache) url(peer, op string, keys []string) string {
+	q := url.Values{"key": keys}
+	if op != "" {
+		q.Set("op", op)
+	}
+	return strings.TrimRight(peer, "/") + p.opts.BasePath + "?" + q.Encode()
+}
+
+// fetch retrieves an entry from a peer, without its body for the "meta"
+// operation, and reports whether it is stale
+func (p *PeerCache) fetch(peer, key, op string) (*Entry, bool, error) {
+	resp, err := p.client().Get(p.url(peer, op, []string{key}))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, ErrNotFoundInCache
+	default:
+		return nil, false, fmt.Errorf("peer %s responded with %s", peer, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	e := &Entry{}
+	if err := e.UnmarshalBinary(b); err != nil {
+		return nil, false, err
+	}
+	return e, resp.Header.Get(peerStaleHeader) != "", nil
+}
+
+// send applies an operation to keys owned by a peer
+func (p *PeerCache) send(peer, method, op string, keys []string, e *Entry) error {
+	var body []byte
+	if e != nil {
+		var err error
+		if body, err = e.MarshalBinary(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, p.url(peer, op, keys), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer %s responded with %s", peer, resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP serves the shard of the instance to the other peers. It should
+// only be reachable from them.
+func (p *PeerCache) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != p.opts.BasePath {
+		http.NotFound(rw, r)
+		return
+	}
+
+	q := r.URL.Query()
+	keys := q["key"]
+	if len(keys) == 0 {
+		http.Error(rw, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch op := q.Get("op"); {
+	case r.Method == "GET":
+		err = p.serveEntry(rw, keys[0], op == "meta")
+	case r.Method == "PUT" && op == "store":
+		var e *Entry
+		if e, err = readEntry(r); err == nil {
+			err = p.local.Store(e.Resource(), keys...)
+		}
+	case r.Method == "POST" && op == "invalidate":
+		p.local.Invalidate(keys...)
+	case r.Method == "POST" && op == "freshen":
+		var e *Entry
+		if e, err = readEntry(r); err == nil {
+			err = p.local.Freshen(e.Resource(), keys...)
+		}
+	case r.Method == "DELETE" && op == "delete":
+		err = p.local.Delete(keys...)
+	default:
+		http.Error(rw, "unsupported operation", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case err == errServed:
+	case err == ErrNotFoundInCache:
+		http.NotFound(rw, r)
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+	default:
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// errServed reports that a response has already been written
+var errServed = errors.New("served")
+
+func (p *PeerCache) serveEntry(rw http.ResponseWriter, key string, meta bool) error {
+	info, err := p.local.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	var e *Entry
+	stale := false
+	if meta {
+		h, err := p.local.Header(key)
+		if err != nil {
+			return err
+		}
+		e = &Entry{StatusCode: h.StatusCode, Header: h.Header}
+	} else {
+		res, err := p.local.Retrieve(key)
+		if err != nil {
+			return err
+		}
+		e, err = NewEntry(res, key)
+		res.Close()
+		if err != nil {
+			return err
+		}
+		stale = res.IsStale()
+	}
+	e.EntryInfo = info
+
+	b, err := e.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if stale {
+		rw.Header().Set(peerStaleHeader, "1")
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Write(b)
+	return errServed
+}
+
+func readEntry(r *http.Request) (*Entry, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := e.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,231 @@
+package negronicache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startPeers runs n peers knowing each other, returning their caches and
+// local shards
+func startPeers(t *testing.T, n int, opts func(i int) PeerOptions) ([]*PeerCache, []Cache) {
+	peers := make([]*PeerCache, n)
+	locals := make([]Cache, n)
+	urls := make([]string, n)
+	for i := range peers {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			peers[i].ServeHTTP(rw, r)
+		}))
+		t.Cleanup(ts.Close)
+		urls[i] = ts.URL
+	}
+
+	for i := range peers {
+		var o PeerOptions
+		if opts != nil {
+			o = opts(i)
+		}
+		locals[i] = NewMemoryCache()
+		peers[i] = NewPeerCache(urls[i], locals[i], o)
+	}
+	for i := range peers {
+		var others []string
+		for j, url := range urls {
+			if j != i {
+				others = append(others, url)
+			}
+		}
+		peers[i].SetPeers(others...)
+	}
+	return peers, locals
+}
+
+func TestPeerCache_Sharding(t *testing.T) {
+	peers, locals := startPeers(t, 3, nil)
+
+	owned := map[string]int{}
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("GET:http://test.com/%d", i)
+		storeBytes(t, peers[i%3], key, key)
+
+		// the owner is the same on every peer
+		owner := peers[0].Owner(key)
+		for _, p := range peers {
+			assert.Equal(t, owner, p.Owner(key))
+		}
+		owned[owner]++
+
+		for j, p := range peers {
+			assert.Equal(t, key, retrieveBody(t, p, key))
+			_, err := locals[j].Retrieve(key)
+			assert.Equal(t, p.self == owner, err == nil)
+		}
+	}
+	assert.Len(t, owned, 3)
+}
+
+func TestPeerCache_StoreVariants(t *testing.T) {
+	peers, locals := startPeers(t, 3, nil)
+	key := testKey
+	variant := key + "::Accept=application/json:"
+	for _, p := range peers {
+		assert.Equal(t, p.Owner(key), p.Owner(variant))
+	}
+
+	h := make(http.Header)
+	h.Set("Vary", "Accept")
+	assert.Nil(t, peers[0].Store(NewResourceBytes(200, []byte("body"), h), key, variant))
+	for i, p := range peers {
+		_, err := locals[i].Retrieve(variant)
+		assert.Equal(t, p.self == p.Owner(key), err == nil)
+		assert.Equal(t, "body", retrieveBody(t, p, variant))
+	}
+
+	peers[1].Invalidate(variant)
+	for _, p := range peers {
+		res, err := p.Retrieve(variant)
+		assert.Nil(t, err)
+		assert.True(t, res.IsStale())
+		res, err = p.Retrieve(key)
+		assert.Nil(t, err)
+		assert.False(t, res.IsStale())
+	}
+
+	assert.Nil(t, peers[2].Delete(key))
+	for i, p := range peers {
+		for _, k := range []string{key, variant} {
+			_, err := locals[i].Retrieve(k)
+			assert.Equal(t, ErrNotFoundInCache, err)
+			_, err = p.Retrieve(k)
+			assert.Equal(t, ErrNotFoundInCache, err)
+		}
+	}
+}
+
+func TestPeerCache_Operations(t *testing.T) {
+	peers, _ := startPeers(t, 2, nil)
+	key := testKey
+	if peers[0].Owner(key) == peers[0].self {
+		peers[0], peers[1] = peers[1], peers[0]
+	}
+	p := peers[0]
+
+	h := make(http.Header)
+	h.Set("ETag", `"v1"`)
+	assert.Nil(t, p.Store(NewResourceBytes(200, []byte("body"), h), key))
+
+	header, err := p.Header(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, header.StatusCode)
+	assert.Equal(t, `"v1"`, header.Header.Get("ETag"))
+
+	info, err := p.Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.Equal(t, int64(4), info.Size)
+
+	p.Invalidate(key)
+	res, err := p.Retrieve(key)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	h = make(http.Header)
+	h.Set("ETag", `"v1"`)
+	h.Set("X-Validated", "yes")
+	assert.Nil(t, p.Freshen(NewResourceBytes(200, nil, h), key))
+	res, err = p.Retrieve(key)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+	assert.Equal(t, "yes", res.Header().Get("X-Validated"))
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+
+	assert.Nil(t, p.Delete(key))
+	_, err = p.Retrieve(key)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = p.Stat(key)
+	assert.Equal(t, ErrNotFoundInCache, err)
+}
+
+func TestPeerCache_Hot(t *testing.T) {
+	hot := NewMemoryCache()
+	peers, locals := startPeers(t, 2, func(i int) PeerOptions {
+		if i == 0 {
+			return PeerOptions{Hot: hot}
+		}
+		return PeerOptions{}
+	})
+	var key string
+	for i := 0; ; i++ {
+		if key = fmt.Sprintf("GET:http://test.com/%d", i); peers[0].Owner(key) != peers[0].self {
+			break
+		}
+	}
+
+	storeBytes(t, peers[1], key, "body")
+	_, err := hot.Retrieve(key)
+	assert.Equal(t, ErrNotFoundInCache, err)
+
+	assert.Equal(t, "body", retrieveBody(t, peers[0], key))
+	assert.Equal(t, "body", retrieveBody(t, hot, key))
+
+	// hot entries are served without reaching the owner
+	assert.Nil(t, locals[1].Delete(key))
+	assert.Equal(t, "body", retrieveBody(t, peers[0], key))
+
+	peers[0].Invalidate(key)
+	res, err := hot.Retrieve(key)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+func TestPeerCache_SetPeers(t *testing.T) {
+	p := NewPeerCache("http://a", NewMemoryCache(), PeerOptions{})
+	assert.Equal(t, "http://a", p.Owner(testKey))
+
+	p.SetPeers("http://b", "http://c")
+	moved := 0
+	for i := 0; i < 100; i++ {
+		if p.Owner(fmt.Sprintf("GET:http://test.com/%d", i)) != "http://a" {
+			moved++
+		}
+	}
+	assert.True(t, moved > 30 && moved < 90, "moved %d keys", moved)
+
+	// removing a peer only moves its own keys
+	before := map[string]string{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("GET:http://test.com/%d", i)
+		before[key] = p.Owner(key)
+	}
+	p.SetPeers("http://b")
+	for key, owner := range before {
+		if owner != "http://c" {
+			assert.Equal(t, owner, p.Owner(key))
+		}
+	}
+}
+
+func TestPeerCache_ServeHTTP(t *testing.T) {
+	p := NewPeerCache("http://a", NewMemoryCache(), PeerOptions{})
+
+	for _, tc := range []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", "/other", http.StatusNotFound},
+		{"GET", "/_negronicache/", http.StatusBadRequest},
+		{"GET", "/_negronicache/?key=GET:http://missing.com", http.StatusNotFound},
+		{"POST", "/_negronicache/?key=k&op=unknown", http.StatusMethodNotAllowed},
+		{"PUT", "/_negronicache/?key=k&op=store", http.StatusInternalServerError},
+	} {
+		rw := httptest.NewRecorder()
+		p.ServeHTTP(rw, httptest.NewRequest(tc.method, tc.url, nil))
+		assert.Equal(t, tc.code, rw.Code, tc.method+" "+tc.url)
+	}
+}
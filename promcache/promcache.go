@@ -0,0 +1,93 @@
+// Package promcache exports the statistics of a negroni-cache Middleware or
+// cache as Prometheus metrics.
+package promcache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+const namespace = "negronicache"
+
+// Collector is a prometheus.Collector reading the statistics of a
+// StatsReporter on every scrape
+type Collector struct {
+	reporter cah.StatsReporter
+
+	hits, staleHits, revalidations, misses *prometheus.Desc
+	bypasses                               *prometheus.Desc
+	stores, storeFailures, storedBytes     *prometheus.Desc
+	droppedWrites                          *prometheus.Desc
+	evictions, entries, bytes              *prometheus.Desc
+	lookupLatency, storeLatency            *prometheus.Desc
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a collector for the reporter. The labels tell apart
+// the metrics of several reporters registered together.
+func NewCollector(reporter cah.StatsReporter, labels prometheus.Labels) *Collector {
+	desc := func(name, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, variableLabels, labels)
+	}
+
+	return &Collector{
+		reporter:      reporter,
+		hits:          desc("hits_total", "Responses served from the cache."),
+		staleHits:     desc("stale_hits_total", "Responses served from the cache while stale."),
+		revalidations: desc("revalidations_total", "Responses served from the cache after a revalidation."),
+		misses:        desc("misses_total", "Lookups which found no usable entry."),
+		bypasses:      desc("bypasses_total", "Requests and responses which bypassed the cache.", "reason"),
+		stores:        desc("stores_total", "Responses stored in the cache."),
+		storeFailures: desc("store_failures_total", "Responses which failed to be stored."),
+		storedBytes:   desc("stored_bytes_total", "Bytes of the response bodies stored."),
+		droppedWrites: desc("dropped_writes_total", "Responses dropped from a full write queue."),
+		evictions:     desc("evictions_total", "Entries evicted from the cache."),
+		entries:       desc("entries", "Entries held by the cache."),
+		bytes:         desc("bytes", "Bytes held by the cache."),
+		lookupLatency: desc("lookup_duration_seconds", "Latency of the cache lookups."),
+		storeLatency:  desc("store_duration_seconds", "Latency of the cache stores."),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.hits, c.staleHits, c.revalidations, c.misses, c.bypasses,
+		c.stores, c.storeFailures, c.storedBytes, c.droppedWrites,
+		c.evictions, c.entries, c.bytes,
+		c.lookupLatency, c.storeLatency,
+	} {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.reporter.CacheStats()
+
+	counter := func(d *prometheus.Desc, v int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	gauge := func(d *prometheus.Desc, v int64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, float64(v))
+	}
+	histogram := func(d *prometheus.Desc, h cah.HistogramStats) {
+		ch <- prometheus.MustNewConstHistogram(d, h.Count, h.Sum, h.Buckets)
+	}
+
+	counter(c.hits, s.Hits)
+	counter(c.staleHits, s.StaleHits)
+	counter(c.revalidations, s.Revalidations)
+	counter(c.misses, s.Misses)
+	for reason, n := range s.Bypasses {
+		counter(c.bypasses, n, reason)
+	}
+	counter(c.stores, s.Stores)
+	counter(c.storeFailures, s.StoreFailures)
+	counter(c.storedBytes, s.StoredBytes)
+	counter(c.droppedWrites, s.DroppedWrites)
+	counter(c.evictions, s.Evictions)
+	gauge(c.entries, s.Entries)
+	gauge(c.bytes, s.Bytes)
+	histogram(c.lookupLatency, s.LookupLatency)
+	histogram(c.storeLatency, s.StoreLatency)
+}
@@ -0,0 +1,62 @@
+package promcache
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+type reporter cah.Stats
+
+func (r reporter) CacheStats() cah.Stats { return cah.Stats(r) }
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(reporter{
+		Hits:     3,
+		Misses:   1,
+		Bypasses: map[string]int64{cah.BypassRequest: 2},
+		Entries:  5,
+		LookupLatency: cah.HistogramStats{
+			Count:   4,
+			Sum:     0.5,
+			Buckets: map[float64]uint64{0.1: 3, 1: 4},
+		},
+	}, prometheus.Labels{"cache": "test"})
+
+	assert.Nil(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP negronicache_hits_total Responses served from the cache.
+# TYPE negronicache_hits_total counter
+negronicache_hits_total{cache="test"} 3
+# HELP negronicache_misses_total Lookups which found no usable entry.
+# TYPE negronicache_misses_total counter
+negronicache_misses_total{cache="test"} 1
+# HELP negronicache_bypasses_total Requests and responses which bypassed the cache.
+# TYPE negronicache_bypasses_total counter
+negronicache_bypasses_total{cache="test",reason="request"} 2
+# HELP negronicache_entries Entries held by the cache.
+# TYPE negronicache_entries gauge
+negronicache_entries{cache="test"} 5
+# HELP negronicache_lookup_duration_seconds Latency of the cache lookups.
+# TYPE negronicache_lookup_duration_seconds histogram
+negronicache_lookup_duration_seconds_bucket{cache="test",le="0.1"} 3
+negronicache_lookup_duration_seconds_bucket{cache="test",le="1"} 4
+negronicache_lookup_duration_seconds_bucket{cache="test",le="+Inf"} 4
+negronicache_lookup_duration_seconds_sum{cache="test"} 0.5
+negronicache_lookup_duration_seconds_count{cache="test"} 4
+`), "negronicache_hits_total", "negronicache_misses_total", "negronicache_bypasses_total",
+		"negronicache_entries", "negronicache_lookup_duration_seconds"))
+}
+
+func TestCollector_Register(t *testing.T) {
+	mw := cah.NewMiddleware(cah.NewMemoryCache())
+	reg := prometheus.NewPedanticRegistry()
+	assert.Nil(t, reg.Register(NewCollector(mw, nil)))
+
+	n, err := testutil.GatherAndCount(reg)
+	assert.Nil(t, err)
+	assert.Equal(t, 13, n)
+}
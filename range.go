@@ -0,0 +1,92 @@
+package negronicache
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Enumerable is implemented by caches that can list their entries, which
+// allows invalidating them by key prefix or pattern. Keys have the form
+// "METHOD:url", with the URL lowercased, e.g. "GET:https://example.com/a".
+type Enumerable interface {
+	// Range calls fn with the metadata of every entry until fn returns false
+	Range(fn func(EntryInfo) bool) error
+	// InvalidatePrefix invalidates the entries whose key starts with prefix
+	// and returns how many were invalidated
+	InvalidatePrefix(prefix string) (int, error)
+	// InvalidateMatch invalidates the entries whose key matches re and
+	// returns how many were invalidated
+	InvalidateMatch(re *regexp.Regexp) (int, error)
+}
+
+var (
+	_ Enumerable = (*cache)(nil)
+	_ Enumerable = (*BoundedCache)(nil)
+)
+
+// Range calls fn for every entry. Legacy v1 entries don't record their key
+// and are skipped until they are migrated by a retrieval.
+func (c *cache) Range(fn func(EntryInfo) bool) error {
+	infos, err := c.entries()
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		meta, err := c.readEntryMeta(fi.Name())
+		if err == ErrNotFoundInCache {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if meta.Key == "" {
+			continue
+		}
+		if !fn(meta.EntryInfo) {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *cache) InvalidatePrefix(prefix string) (int, error) {
+	return invalidateWhere(c, func(info EntryInfo) bool {
+		return strings.HasPrefix(info.Key, prefix)
+	})
+}
+
+func (c *cache) InvalidateMatch(re *regexp.Regexp) (int, error) {
+	return invalidateWhere(c, func(info EntryInfo) bool {
+		return re.MatchString(info.Key)
+	})
+}
+
+func (b *BoundedCache) Range(fn func(EntryInfo) bool) error {
+	return b.c.Range(fn)
+}
+
+func (b *BoundedCache) InvalidatePrefix(prefix string) (int, error) {
+	return b.c.InvalidatePrefix(prefix)
+}
+
+func (b *BoundedCache) InvalidateMatch(re *regexp.Regexp) (int, error) {
+	return b.c.InvalidateMatch(re)
+}
+
+// invalidateWhere invalidates the entries of c satisfying match
+func invalidateWhere(c interface {
+	Cache
+	Range(fn func(EntryInfo) bool) error
+}, match func(info EntryInfo) bool) (int, error) {
+	var keys []string
+	err := c.Range(func(info EntryInfo) bool {
+		if match(info) {
+			keys = append(keys, info.Key)
+		}
+		return true
+	})
+	if len(keys) > 0 {
+		c.Invalidate(keys...)
+	}
+	return len(keys), err
+}
@@ -0,0 +1,69 @@
+package negronicache
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func rangeTestCache(t *testing.T) Cache {
+	c := NewMemoryCache()
+	for _, key := range []string{
+		"GET:https://api.example.com/v2/catalog/1",
+		"GET:https://api.example.com/v2/catalog/2",
+		"GET:https://api.example.com/v2/users/1",
+		"HEAD:https://api.example.com/v2/catalog/1",
+	} {
+		assert.Nil(t, c.Store(NewResourceBytes(200, []byte(key), make(http.Header)), key))
+	}
+	return c
+}
+
+func TestRange_Range(t *testing.T) {
+	c := rangeTestCache(t).(Enumerable)
+
+	var keys []string
+	assert.Nil(t, c.Range(func(info EntryInfo) bool {
+		keys = append(keys, info.Key)
+		return true
+	}))
+	sort.Strings(keys)
+	assert.Equal(t, 4, len(keys))
+	assert.Equal(t, "GET:https://api.example.com/v2/catalog/1", keys[0])
+
+	n := 0
+	assert.Nil(t, c.Range(func(info EntryInfo) bool {
+		n++
+		return false
+	}))
+	assert.Equal(t, 1, n)
+}
+
+func TestRange_InvalidatePrefix(t *testing.T) {
+	c := rangeTestCache(t)
+
+	n, err := c.(Enumerable).InvalidatePrefix("GET:https://api.example.com/v2/catalog/")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	res, _ := c.Retrieve("GET:https://api.example.com/v2/catalog/2")
+	assert.True(t, res.IsStale())
+	res, _ = c.Retrieve("GET:https://api.example.com/v2/users/1")
+	assert.False(t, res.IsStale())
+}
+
+func TestRange_InvalidateMatch(t *testing.T) {
+	c := rangeTestCache(t)
+
+	n, err := c.(Enumerable).InvalidateMatch(regexp.MustCompile(`/catalog/1$`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	res, _ := c.Retrieve("HEAD:https://api.example.com/v2/catalog/1")
+	assert.True(t, res.IsStale())
+	res, _ = c.Retrieve("GET:https://api.example.com/v2/catalog/2")
+	assert.False(t, res.IsStale())
+}
@@ -0,0 +1,88 @@
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+// Bus is an InvalidationBus publishing JSON encoded invalidations on a Redis
+// pub/sub channel
+type Bus struct {
+	client  redis.UniversalClient
+	channel string
+
+	mu     sync.Mutex
+	pubsub *redis.PubSub
+	subs   []func(cah.Invalidation)
+}
+
+var _ cah.InvalidationBus = (*Bus)(nil)
+
+// NewBus returns a bus using the given channel
+func NewBus(client redis.UniversalClient, channel string) *Bus {
+	return &Bus{client: client, channel: channel}
+}
+
+func (b *Bus) Publish(inv cah.Invalidation) error {
+	msg, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, msg).Err()
+}
+
+// Subscribe calls fn with every invalidation published on the channel. The
+// channel is subscribed to on the first call.
+func (b *Bus) Subscribe(fn func(cah.Invalidation)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subs = append(b.subs, fn)
+	if b.pubsub != nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	// wait for the subscription to be confirmed, so that no invalidation
+	// published after Subscribe returns is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		b.subs = nil
+		return err
+	}
+	b.pubsub = pubsub
+	go b.receive(pubsub.Channel())
+	return nil
+}
+
+func (b *Bus) receive(ch <-chan *redis.Message) {
+	for msg := range ch {
+		var inv cah.Invalidation
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+			continue
+		}
+
+		b.mu.Lock()
+		subs := b.subs
+		b.mu.Unlock()
+		for _, fn := range subs {
+			fn(inv)
+		}
+	}
+}
+
+func (b *Bus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pubsub == nil {
+		return nil
+	}
+	err := b.pubsub.Close()
+	b.pubsub = nil
+	return err
+}
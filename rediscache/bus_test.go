@@ -0,0 +1,52 @@
+package rediscache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+func TestBus(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	a, b := NewBus(client, "invalidations"), NewBus(client, "invalidations")
+	defer a.Close()
+	defer b.Close()
+
+	received := make(chan cah.Invalidation, 1)
+	assert.Nil(t, b.Subscribe(func(inv cah.Invalidation) { received <- inv }))
+	assert.Nil(t, a.Publish(cah.Invalidation{ID: "1", Keys: []string{testKey}, Hard: true}))
+
+	select {
+	case inv := <-received:
+		assert.Equal(t, "1", inv.ID)
+		assert.Equal(t, []string{testKey}, inv.Keys)
+		assert.True(t, inv.Hard)
+	case <-time.After(2 * time.Second):
+		t.Fatal("invalidation not received")
+	}
+}
+
+func TestBus_BroadcastCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	a, err := cah.NewBroadcastCache(cah.NewMemoryCache(), NewBus(client, "invalidations"))
+	assert.Nil(t, err)
+	local := cah.NewMemoryCache()
+	_, err = cah.NewBroadcastCache(local, NewBus(client, "invalidations"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, local.Store(resource("body"), testKey))
+	a.Invalidate(testKey)
+
+	assert.Eventually(t, func() bool {
+		res, err := local.Retrieve(testKey)
+		return err == nil && res.IsStale()
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,309 @@
+// Package rediscache provides a negroni-cache Cache backed by Redis, so that
+// horizontally scaled instances share their cached responses
+package rediscache
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+const (
+	defaultNamespace = "negronicache:"
+	freshenRetries   = 3
+)
+
+// Options configures a Redis Cache
+type Options struct {
+	// Namespace prefixes all the Redis keys, "negronicache:" by default
+	Namespace string
+	// Grace is added to the remaining freshness of a resource to derive the
+	// TTL of its entry, keeping stale entries around for revalidation.
+	// Resources without any freshness left are only stored if it is set.
+	Grace time.Duration
+	// Shared derives TTLs from s-maxage rather than max-age
+	Shared bool
+}
+
+// Cache stores entries in Redis under namespaced keys:
+//
+//	<ns>entry:<key>     the entry in the v2 format, with a TTL
+//	<ns>stale:<key>     the invalidation marker, expiring with the entry
+//	<ns>variants:<key>  the keys stored alongside the entry
+//	<ns>tag:<tag>       the keys tagged with tag
+type Cache struct {
+	client redis.UniversalClient
+	opts   Options
+}
+
+var (
+	_ cah.Cache          = (*Cache)(nil)
+	_ cah.TagInvalidator = (*Cache)(nil)
+)
+
+// New returns a Cache storing entries with the given client
+func New(client redis.UniversalClient, opts Options) *Cache {
+	if opts.Namespace == "" {
+		opts.Namespace = defaultNamespace
+	}
+	return &Cache{client: client, opts: opts}
+}
+
+func (c *Cache) entryKey(key string) string    { return c.opts.Namespace + "entry:" + key }
+func (c *Cache) staleKey(key string) string    { return c.opts.Namespace + "stale:" + key }
+func (c *Cache) variantsKey(key string) string { return c.opts.Namespace + "variants:" + key }
+func (c *Cache) tagKey(tag string) string      { return c.opts.Namespace + "tag:" + tag }
+
+// ttl returns the TTL of an entry for the resource, zero if it shouldn't
+// be stored
+func (c *Cache) ttl(res *cah.Resource) time.Duration {
+	return res.RemainingFreshness(c.opts.Shared) + c.opts.Grace
+}
+
+// addToSet adds a member to a set and extends the set TTL to at least the
+// given one, in milliseconds
+var addToSet = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// setMarker sets an invalidation marker expiring along with the entry
+var setMarker = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+elseif ttl > 0 then
+	redis.call('SET', KEYS[2], ARGV[1], 'PX', ttl)
+else
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+return 1
+`)
+
+func (c *Cache) get(key string) ([]byte, error) {
+	b, err := c.client.Get(context.Background(), c.entryKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, cah.ErrNotFoundInCache
+	}
+	return b, err
+}
+
+func (c *Cache) Header(key string) (cah.Header, error) {
+	b, err := c.get(key)
+	if err != nil {
+		return cah.Header{}, err
+	}
+	h, _, err := cah.UnmarshalEntryInfo(b)
+	if err != nil {
+		c.Delete(key)
+		return cah.Header{}, cah.ErrNotFoundInCache
+	}
+	return h, nil
+}
+
+func (c *Cache) Stat(key string) (cah.EntryInfo, error) {
+	b, err := c.get(key)
+	if err != nil {
+		return cah.EntryInfo{}, err
+	}
+	_, info, err := cah.UnmarshalEntryInfo(b)
+	if err != nil {
+		c.Delete(key)
+		return cah.EntryInfo{}, cah.ErrNotFoundInCache
+	}
+	return info, nil
+}
+
+func (c *Cache) Store(res *cah.Resource, keys ...string) error {
+	ctx := context.Background()
+	ttl := c.ttl(res)
+	if ttl <= 0 {
+		return nil
+	}
+
+	e, err := cah.NewEntry(res, "")
+	if err != nil {
+		return err
+	}
+
+	tagged := map[string]bool{}
+	for _, tag := range e.Tags {
+		tagged[tag] = true
+	}
+
+	pipe := c.client.TxPipeline()
+	for _, key := range keys {
+		// the key leaves the tags of the entry it replaces
+		if b, err := c.get(key); err == nil {
+			if _, info, err := cah.UnmarshalEntryInfo(b); err == nil {
+				for _, tag := range info.Tags {
+					if !tagged[tag] {
+						pipe.SRem(ctx, c.tagKey(tag), key)
+					}
+				}
+			}
+		}
+
+		e.Key = key
+		b, err := e.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, c.entryKey(key), b, ttl)
+		// the entry has been replaced, so any marker is outdated
+		pipe.Del(ctx, c.staleKey(key))
+		for _, variant := range keys {
+			if variant != key {
+				addToSet.Eval(ctx, pipe, []string{c.variantsKey(key)}, variant, ttl.Milliseconds())
+			}
+		}
+		for _, tag := range e.Tags {
+			addToSet.Eval(ctx, pipe, []string{c.tagKey(tag)}, key, ttl.Milliseconds())
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (c *Cache) Retrieve(key string) (*cah.Resource, error) {
+	ctx := context.Background()
+	pipe := c.client.Pipeline()
+	entry := pipe.Get(ctx, c.entryKey(key))
+	marker := pipe.Exists(ctx, c.staleKey(key))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	b, err := entry.Bytes()
+	if err == redis.Nil {
+		return nil, cah.ErrNotFoundInCache
+	} else if err != nil {
+		return nil, err
+	}
+
+	var e cah.Entry
+	if err := e.UnmarshalBinary(b); err != nil {
+		c.Delete(key)
+		return nil, cah.ErrNotFoundInCache
+	}
+
+	res := e.Resource()
+	if marker.Val() > 0 {
+		res.MarkStale()
+	}
+	return res, nil
+}
+
+func (c *Cache) Invalidate(keys ...string) {
+	ctx := context.Background()
+	now := strconv.FormatInt(cah.Clock().UnixNano(), 10)
+	for _, key := range keys {
+		setMarker.Run(ctx, c.client, []string{c.entryKey(key), c.staleKey(key)}, now)
+	}
+}
+
+// InvalidateTags invalidates the entries tagged with any of the tags
+func (c *Cache) InvalidateTags(tags ...string) error {
+	ctx := context.Background()
+	for _, tag := range tags {
+		keys, err := c.client.SMembers(ctx, c.tagKey(tag)).Result()
+		if err != nil {
+			return err
+		}
+		c.Invalidate(keys...)
+	}
+	return nil
+}
+
+// Delete erases the entries stored for the keys, along with their
+// variants and markers
+func (c *Cache) Delete(keys ...string) error {
+	ctx := context.Background()
+	targets := map[string]bool{}
+	for _, key := range keys {
+		targets[key] = true
+		variants, err := c.client.SMembers(ctx, c.variantsKey(key)).Result()
+		if err != nil {
+			return err
+		}
+		for _, variant := range variants {
+			targets[variant] = true
+		}
+	}
+
+	pipe := c.client.TxPipeline()
+	for key := range targets {
+		if b, err := c.get(key); err == nil {
+			if _, info, err := cah.UnmarshalEntryInfo(b); err == nil {
+				for _, tag := range info.Tags {
+					pipe.SRem(ctx, c.tagKey(tag), key)
+				}
+			}
+		}
+		pipe.Del(ctx, c.entryKey(key), c.staleKey(key), c.variantsKey(key))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Freshen updates the headers of the entries with a validated resource,
+// retrying a few times if an entry is concurrently modified. It returns
+// redis.TxFailedErr once the retries are exhausted.
+func (c *Cache) Freshen(res *cah.Resource, keys ...string) error {
+	ctx := context.Background()
+	for _, key := range keys {
+		var err error = redis.TxFailedErr
+		for i := 0; i < freshenRetries && err == redis.TxFailedErr; i++ {
+			err = c.client.Watch(ctx, func(tx *redis.Tx) error {
+				return c.freshen(ctx, tx, res, key)
+			}, c.entryKey(key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) freshen(ctx context.Context, tx *redis.Tx, res *cah.Resource, key string) error {
+	b, err := tx.Get(ctx, c.entryKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var e cah.Entry
+	if err := e.UnmarshalBinary(b); err != nil {
+		return nil
+	}
+	if !e.Freshen(res) {
+		c.Invalidate(key)
+		return nil
+	}
+
+	ttl := c.ttl(e.Resource())
+	if ttl <= 0 {
+		ttl = tx.PTTL(ctx, c.entryKey(key)).Val()
+	}
+	if b, err = e.MarshalBinary(); err != nil {
+		return err
+	}
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if ttl > 0 {
+			pipe.Set(ctx, c.entryKey(key), b, ttl)
+		} else {
+			pipe.Set(ctx, c.entryKey(key), b, redis.KeepTTL)
+		}
+		pipe.Del(ctx, c.staleKey(key))
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,183 @@
+package rediscache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	cah "github.com/trumanw/negroni-cache"
+)
+
+const testKey = "GET:http://test.com"
+
+func setup(t *testing.T, opts Options) (*Cache, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return New(client, opts), mr
+}
+
+func resource(body string, headers ...string) *cah.Resource {
+	h := make(http.Header)
+	h.Set("Date", cah.Clock().Format(http.TimeFormat))
+	for i := 0; i+1 < len(headers); i += 2 {
+		h.Set(headers[i], headers[i+1])
+	}
+	return cah.NewResourceBytes(200, []byte(body), h)
+}
+
+func TestCache_StoreRetrieve(t *testing.T) {
+	c, mr := setup(t, Options{Grace: time.Minute})
+
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+	assert.True(t, mr.Exists("negronicache:entry:"+testKey))
+	ttl := mr.TTL("negronicache:entry:" + testKey)
+	assert.True(t, ttl > time.Minute && ttl <= 2*time.Minute)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+	assert.False(t, res.IsStale())
+
+	h, err := c.Header(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, h.StatusCode)
+
+	info, err := c.Stat(testKey)
+	assert.Nil(t, err)
+	assert.Equal(t, testKey, info.Key)
+
+	mr.FastForward(3 * time.Minute)
+	_, err = c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_NoFreshness(t *testing.T) {
+	c, _ := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body"), testKey))
+	_, err := c.Retrieve(testKey)
+	assert.Equal(t, cah.ErrNotFoundInCache, err)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	c, mr := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+
+	c.Invalidate(testKey, "GET:http://missing.com")
+	assert.False(t, mr.Exists("negronicache:stale:GET:http://missing.com"))
+	assert.True(t, mr.TTL("negronicache:stale:"+testKey) > 0)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60"), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_Tags(t *testing.T) {
+	c, _ := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("1", "Cache-Control", "max-age=60", cah.TagHeader, "catalog"), "GET:http://a.com/1"))
+	assert.Nil(t, c.Store(resource("2", "Cache-Control", "max-age=60", cah.TagHeader, "users"), "GET:http://a.com/2"))
+
+	assert.Nil(t, c.InvalidateTags("catalog"))
+
+	res, _ := c.Retrieve("GET:http://a.com/1")
+	assert.True(t, res.IsStale())
+	res, _ = c.Retrieve("GET:http://a.com/2")
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_RetagOnStore(t *testing.T) {
+	c, mr := setup(t, Options{})
+	key := "GET:http://a.com/1"
+	assert.Nil(t, c.Store(resource("1", "Cache-Control", "max-age=60", cah.TagHeader, "catalog, sale"), key))
+	assert.True(t, mr.Exists("negronicache:tag:sale"))
+	assert.Nil(t, c.Store(resource("2", "Cache-Control", "max-age=60", cah.TagHeader, "catalog"), key))
+
+	members, _ := mr.Members("negronicache:tag:catalog")
+	assert.Equal(t, []string{key}, members)
+	members, _ = mr.Members("negronicache:tag:sale")
+	assert.Empty(t, members)
+
+	assert.Nil(t, c.InvalidateTags("sale"))
+	res, err := c.Retrieve(key)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestCache_Delete(t *testing.T) {
+	c, mr := setup(t, Options{})
+	vary := testKey + "::Accept=json:"
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60", cah.TagHeader, "catalog"), testKey, vary))
+
+	assert.Nil(t, c.Delete(testKey))
+	for _, key := range []string{testKey, vary} {
+		_, err := c.Retrieve(key)
+		assert.Equal(t, cah.ErrNotFoundInCache, err)
+	}
+	assert.False(t, mr.Exists("negronicache:tag:catalog"))
+}
+
+func TestCache_Freshen(t *testing.T) {
+	c, _ := setup(t, Options{})
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60", "ETag", `"v1"`), testKey))
+	c.Invalidate(testKey)
+
+	assert.Nil(t, c.Freshen(resource("", "Cache-Control", "max-age=120", "ETag", `"v1"`), testKey))
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+	assert.Equal(t, "max-age=120", res.Header().Get("Cache-Control"))
+
+	assert.Nil(t, c.Freshen(resource("", "ETag", `"v2"`), testKey))
+	res, err = c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+}
+
+// conflictHook modifies the entry whenever it is read, failing the
+// transactions watching it
+type conflictHook struct {
+	mr    *miniredis.Miniredis
+	key   string
+	reads int
+}
+
+func (h *conflictHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *conflictHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		if cmd.Name() == "get" && cmd.Args()[1] == h.key {
+			h.reads++
+			v, _ := h.mr.Get(h.key)
+			h.mr.Set(h.key, v)
+		}
+		return err
+	}
+}
+
+func (h *conflictHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestCache_FreshenConflict(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	c := New(client, Options{})
+	assert.Nil(t, c.Store(resource("body", "Cache-Control", "max-age=60", "ETag", `"v1"`), testKey))
+
+	hook := &conflictHook{mr: mr, key: c.entryKey(testKey)}
+	client.AddHook(hook)
+	err := c.Freshen(resource("", "Cache-Control", "max-age=120", "ETag", `"v1"`), testKey)
+	assert.Equal(t, redis.TxFailedErr, err)
+	assert.Equal(t, freshenRetries, hook.reads)
+}
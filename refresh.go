@@ -0,0 +1,93 @@
+package negronicache
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// random returns a number in [0, 1), replaced by tests
+var random = rand.Float64
+
+// xfetch reports whether an entry whose fill took delta should be refreshed
+// while it stays fresh for remaining, following the XFetch algorithm of
+// Vattani et al. The probability grows as the entry approaches expiry and
+// with the time it takes to fill it.
+func xfetch(delta, remaining time.Duration, beta, rnd float64) bool {
+	return -float64(delta)*beta*math.Log(rnd) >= float64(remaining)
+}
+
+// jitterFraction maps a key to [0, 1), spreading the expiry of entries
+// stored together
+func jitterFraction(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// jitter returns how much earlier than ttl an entry expires, up to
+// TTLJitter of ttl depending on the key
+func (ch *Middleware) jitter(ttl time.Duration, r *CacheRequest) time.Duration {
+	if ch.TTLJitter <= 0 {
+		return 0
+	}
+	return time.Duration(float64(ttl) * ch.TTLJitter * jitterFraction(r.Key.String()))
+}
+
+// refreshEarly reports whether a fresh resource served from the cache
+// should be refreshed in the background before it expires
+func (ch *Middleware) refreshEarly(res *Resource, r *CacheRequest) bool {
+	if ch.EarlyRefresh <= 0 {
+		return false
+	}
+	fresh, err := ch.Freshness(res, r)
+	if err != nil || fresh <= 0 {
+		return false
+	}
+	delta := res.ResponseTime.Sub(res.RequestTime)
+	if delta <= 0 {
+		return false
+	}
+	return xfetch(delta, fresh, ch.EarlyRefresh, random())
+}
+
+// refresh fetches the response to a request from the next handler in the
+// background and stores it, unless the key is already being refreshed
+func (ch *Middleware) refresh(r *CacheRequest, next http.HandlerFunc) {
+	key := r.Key.String()
+	if _, running := ch.refreshing.LoadOrStore(key, true); running {
+		return
+	}
+
+	req := r.Request.Clone(detachedContext(context.Background(), r.Context()))
+	// the cached response isn't sent, so a full response is needed
+	for _, header := range []string{"If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(header)
+	}
+	cReq, err := NewCacheRequest(req)
+	if err != nil {
+		ch.refreshing.Delete(key)
+		return
+	}
+
+	logDebug(ch.Logger, "refreshing early", "key", key)
+	Writes.Add(1)
+	go func() {
+		defer Writes.Done()
+		defer ch.refreshing.Delete(key)
+		ch.UpstreamWithCache(&discardWriter{header: http.Header{}}, cReq, next)
+	}()
+}
+
+// discardWriter is a ResponseWriter discarding the response, for requests
+// made by the cache itself
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(status int)      {}
@@ -0,0 +1,91 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXFetch(t *testing.T) {
+	// -ln(0.5) * 1s ≈ 0.69s
+	assert.True(t, xfetch(time.Second, 500*time.Millisecond, 1, 0.5))
+	assert.False(t, xfetch(time.Second, time.Second, 1, 0.5))
+	assert.True(t, xfetch(time.Second, time.Second, 2, 0.5))
+	assert.False(t, xfetch(time.Second, time.Minute, 1, 0.99))
+}
+
+func TestJitter(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	r, _ := NewCacheRequest(httptest.NewRequest("GET", "http://example.com/a", nil))
+	assert.Equal(t, time.Duration(0), mw.jitter(100*time.Second, r))
+
+	mw.TTLJitter = 0.5
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 10; i++ {
+		r, _ := NewCacheRequest(httptest.NewRequest("GET", fmt.Sprintf("http://example.com/%d", i), nil))
+		j := mw.jitter(100*time.Second, r)
+		assert.True(t, j >= 0 && j < 50*time.Second)
+		assert.Equal(t, j, mw.jitter(100*time.Second, r))
+		seen[j] = true
+	}
+	assert.True(t, len(seen) > 1)
+}
+
+func TestMiddleware_JitterStored(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	mw.TTLJitter = 0.5
+	res := NewResourceBytes(200, nil, http.Header{
+		"Cache-Control": {"max-age=100"},
+		"Date":          {Clock().Format(http.TimeFormat)},
+	})
+	r, _ := NewCacheRequest(httptest.NewRequest("GET", "http://example.com/a", nil))
+
+	// the jittered lifetime is stored, so that every reader agrees on it
+	mw.applyTTL(res, r)
+	ttl := 100*time.Second - mw.jitter(100*time.Second, r)
+	assert.Equal(t, strconv.Itoa(int(ttl/time.Second)), res.Header().Get(TTLHeader))
+	maxAge, _ := res.MaxAge(false)
+	assert.Equal(t, ttl.Truncate(time.Second), maxAge)
+	fresh, _ := mw.Freshness(res, r)
+	assert.InDelta(t, float64(res.RemainingFreshness(false)), float64(fresh), float64(time.Second))
+}
+
+func TestMiddleware_EarlyRefresh(t *testing.T) {
+	defer func(r func() float64) { random = r }(random)
+
+	var fetches int64
+	mw := NewMiddleware(NewMemoryCache())
+	mw.EarlyRefresh = 1
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "body %d", n)
+	}))
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/a", nil))
+		Writes.Wait()
+		return rec
+	}
+
+	get()
+	random = func() float64 { return 0.999 }
+	assert.Equal(t, "body 1", get().Body.String())
+	assert.Equal(t, int64(1), atomic.LoadInt64(&fetches))
+
+	// the refreshed response is stored while the cached one is served
+	random = func() float64 { return 0 }
+	rec := get()
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+	assert.Equal(t, "body 1", rec.Body.String())
+	assert.Equal(t, int64(2), atomic.LoadInt64(&fetches))
+
+	random = func() float64 { return 0.999 }
+	assert.Equal(t, "body 2", get().Body.String())
+}
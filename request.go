@@ -11,6 +11,8 @@ type CacheRequest struct {
 	Key          Key
 	Time         time.Time
 	CacheControl CacheControl
+	// explain collects the decisions made for the request in explain mode
+	explain *explainer
 }
 
 func NewCacheRequest(r *http.Request) (*CacheRequest, error) {
@@ -32,23 +34,31 @@ func NewCacheRequest(r *http.Request) (*CacheRequest, error) {
 }
 
 func (r *CacheRequest) isCacheable() bool {
+	return r.uncacheableReason() == ""
+}
+
+// uncacheableReason explains why the request can't be served from the
+// cache, or returns "" if it can
+func (r *CacheRequest) uncacheableReason() string {
 	if !(r.Method == "GET" || r.Method == "HEAD") {
-		return false
+		return "method " + r.Method
 	}
 
-	if r.Header.Get("If-Match") != "" ||
-		r.Header.Get("If-Unmodified-Since") != "" ||
-		r.Header.Get("If-Range") != "" {
-		return false
+	for _, header := range []string{"If-Match", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(header) != "" {
+			return "conditional header " + header
+		}
 	}
 
 	if maxAge, ok := r.CacheControl.Get("max-age"); ok && maxAge == "0" {
-		return false
+		return "request Cache-Control max-age=0"
 	}
 
-	if r.CacheControl.Has("no-store") || r.CacheControl.Has("no-cache") {
-		return false
+	for _, directive := range []string{"no-store", "no-cache"} {
+		if r.CacheControl.Has(directive) {
+			return "request Cache-Control " + directive
+		}
 	}
 
-	return true
+	return ""
 }
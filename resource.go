@@ -13,6 +13,9 @@ import (
 const (
 	lastModDivisor = 10
 	viaPseudonym   = "httpcache"
+	// TagHeader lists tags, separated by commas or spaces, by which a
+	// response can be invalidated along with others
+	TagHeader = "Cache-Tag"
 )
 
 var Clock = func() time.Time {
@@ -113,7 +116,7 @@ func (r *Resource) Expires() (time.Time, error) {
 func (r *Resource) MustValidate(shared bool) bool {
 	cc, err := r.cacheControl()
 	if err != nil {
-		debugf("Error parsing Cache-Control: ", err.Error())
+		logDebug(nil, "parsing Cache-Control failed", "error", err)
 		return true
 	}
 
@@ -160,6 +163,10 @@ func (r *Resource) Age() (time.Duration, error) {
 }
 
 func (r *Resource) MaxAge(shared bool) (time.Duration, error) {
+	if ttl, err := intHeader(TTLHeader, r.header); err == nil {
+		return time.Second * time.Duration(ttl), nil
+	}
+
 	cc, err := r.cacheControl()
 	if err != nil {
 		return time.Duration(0), err
@@ -192,21 +199,42 @@ func (r *Resource) MaxAge(shared bool) (time.Duration, error) {
 	return time.Duration(0), nil
 }
 
+// RemainingFreshness returns how long the resource stays fresh, ignoring
+// request directives, which is used to derive the expiry of cache entries
+func (r *Resource) RemainingFreshness(shared bool) time.Duration {
+	lifetime, err := r.MaxAge(shared)
+	if err != nil {
+		return time.Duration(0)
+	}
+
+	if hFresh := r.HeuristicFreshness(); hFresh > lifetime {
+		lifetime = hFresh
+	}
+
+	if age, err := r.Age(); err == nil {
+		lifetime -= age
+	}
+
+	if lifetime < 0 {
+		return time.Duration(0)
+	}
+	return lifetime
+}
+
 func (r *Resource) RemovePrivateHeaders() {
 	cc, err := r.cacheControl()
 	if err != nil {
-		debugf("Error parsing Cache-Control: %s", err.Error())
+		logDebug(nil, "parsing Cache-Control failed", "error", err)
 	}
 
 	for _, p := range cc["private"] {
-		debugf("removing private header %q", p)
+		logDebug(nil, "removing private header", "header", p)
 		r.header.Del(p)
 	}
 }
 
 func (r *Resource) HasValidators() bool {
 	if r.header.Get("Last-Modified") != "" || r.header.Get("ETag") != "" {
-		debugf("has valiator")
 		return true
 	}
 
@@ -214,9 +242,13 @@ func (r *Resource) HasValidators() bool {
 }
 
 func (r *Resource) HasExplicitExpiration() bool {
+	if r.header.Get(TTLHeader) != "" {
+		return true
+	}
+
 	cc, err := r.cacheControl()
 	if err != nil {
-		debugf("Error parsing Cache-Control: %s", err.Error())
+		logDebug(nil, "parsing Cache-Control failed", "error", err)
 		return false
 	}
 
@@ -248,3 +280,14 @@ func (r *Resource) Via() string {
 	via = append(via, fmt.Sprintf("1.1 %s", viaPseudonym))
 	return strings.Join(via, ",")
 }
+
+// Tags returns the tags listed in the Cache-Tag header
+func (r *Resource) Tags() []string {
+	var tags []string
+	for _, header := range r.header[TagHeader] {
+		tags = append(tags, strings.FieldsFunc(header, func(c rune) bool {
+			return c == ',' || c == ' '
+		})...)
+	}
+	return tags
+}
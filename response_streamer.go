@@ -13,6 +13,7 @@ type ResponseStreamer struct {
     *stream.Stream
     // C will be closed by WriteHeader to signal the headers' writing
     C chan struct{}
+    wroteHeader bool
 }
 
 func NewResponseStreamer(w http.ResponseWriter) *ResponseStreamer {
@@ -34,12 +35,20 @@ func (rs *ResponseStreamer) WaitHeaders() {
 }
 
 func(rs *ResponseStreamer) WriteHeader(status int) {
+    if rs.wroteHeader {
+        return
+    }
+    rs.wroteHeader = true
     defer close(rs.C)
     rs.StatusCode = status
     rs.ResponseWriter.WriteHeader(status)
 }
 
 func(rs *ResponseStreamer) Write(b []byte) (int, error) {
+    // like net/http, a Write without WriteHeader implies 200 OK
+    if !rs.wroteHeader {
+        rs.WriteHeader(http.StatusOK)
+    }
     rs.Stream.Write(b)
     return rs.ResponseWriter.Write(b)
 }
@@ -0,0 +1,223 @@
+package negronicache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons a request bypasses the cache
+const (
+	// BypassRequest counts requests which aren't cacheable, e.g. POSTs
+	BypassRequest = "request"
+	// BypassResponse counts responses which aren't cacheable, e.g. no-store
+	BypassResponse = "response"
+	// BypassLookupError counts requests whose lookup failed
+	BypassLookupError = "lookup_error"
+	// BypassLookupTimeout counts requests whose lookup exceeded the
+	// LookupTimeout of the middleware
+	BypassLookupTimeout = "lookup_timeout"
+	// BypassCircuitOpen counts requests skipping the cache while the
+	// Breaker of the middleware is open
+	BypassCircuitOpen = "circuit_open"
+	// BypassAdmission counts responses rejected by the AdmissionPolicy of
+	// the middleware
+	BypassAdmission = "admission"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = [...]float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Stats is a snapshot of the counters and gauges of a Middleware or a cache
+type Stats struct {
+	// Hits counts responses served from the cache, StaleHits those served
+	// while stale and Revalidations those served after a revalidation
+	Hits, StaleHits, Revalidations int64
+	Misses                         int64
+	Bypasses                       map[string]int64
+	// Stores counts stored responses and StoreFailures failed stores
+	Stores, StoreFailures int64
+	// StoredBytes counts the bytes of the bodies stored
+	StoredBytes int64
+	// DroppedWrites counts responses dropped from a full write queue
+	DroppedWrites int64
+	Evictions     int64
+	// Entries and Bytes are gauges of the size of the cache, when known
+	Entries, Bytes int64
+
+	LookupLatency, StoreLatency HistogramStats
+}
+
+// HistogramStats is a snapshot of a latency histogram
+type HistogramStats struct {
+	Count uint64
+	// Sum is the total of the observations in seconds
+	Sum float64
+	// Buckets maps upper bounds in seconds to the cumulative count of
+	// observations up to them
+	Buckets map[float64]uint64
+}
+
+// StatsReporter is implemented by the Middleware and by caches exposing
+// their statistics
+type StatsReporter interface {
+	CacheStats() Stats
+}
+
+// histogram is a lock-free latency histogram, usable as its zero value
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64
+	count  uint64
+	sum    int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d.Seconds() > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) snapshot() HistogramStats {
+	s := HistogramStats{
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+		Buckets: make(map[float64]uint64, len(latencyBuckets)),
+	}
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Buckets[bound] = cumulative
+	}
+	return s
+}
+
+// metrics records the statistics of a Middleware or a cache, usable as its
+// zero value
+type metrics struct {
+	hits, staleHits, revalidations, misses int64
+	stores, storeFailures, storedBytes     int64
+	droppedWrites                          int64
+	lookup, store                          histogram
+
+	mu       sync.Mutex
+	bypasses map[string]int64
+}
+
+func (m *metrics) add(counter *int64, n int64) {
+	atomic.AddInt64(counter, n)
+}
+
+func (m *metrics) bypass(reason string) {
+	m.mu.Lock()
+	if m.bypasses == nil {
+		m.bypasses = map[string]int64{}
+	}
+	m.bypasses[reason]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) snapshot() Stats {
+	s := Stats{
+		Hits:          atomic.LoadInt64(&m.hits),
+		StaleHits:     atomic.LoadInt64(&m.staleHits),
+		Revalidations: atomic.LoadInt64(&m.revalidations),
+		Misses:        atomic.LoadInt64(&m.misses),
+		Stores:        atomic.LoadInt64(&m.stores),
+		StoreFailures: atomic.LoadInt64(&m.storeFailures),
+		StoredBytes:   atomic.LoadInt64(&m.storedBytes),
+		DroppedWrites: atomic.LoadInt64(&m.droppedWrites),
+		LookupLatency: m.lookup.snapshot(),
+		StoreLatency:  m.store.snapshot(),
+		Bypasses:      map[string]int64{},
+	}
+	m.mu.Lock()
+	for reason, n := range m.bypasses {
+		s.Bypasses[reason] = n
+	}
+	m.mu.Unlock()
+	return s
+}
+
+// InstrumentedCache records the statistics of any cache. Evictions and size
+// gauges are reported if the wrapped cache is a StatsReporter itself.
+type InstrumentedCache struct {
+	Cache
+	metrics metrics
+}
+
+var (
+	_ Cache         = (*InstrumentedCache)(nil)
+	_ StatsReporter = (*InstrumentedCache)(nil)
+	_ StatsReporter = (*BoundedCache)(nil)
+	_ StatsReporter = (*Middleware)(nil)
+)
+
+// NewInstrumentedCache returns a cache recording the statistics of c
+func NewInstrumentedCache(c Cache) *InstrumentedCache {
+	return &InstrumentedCache{Cache: c}
+}
+
+func (c *InstrumentedCache) Retrieve(key string) (*Resource, error) {
+	t := time.Now()
+	res, err := c.Cache.Retrieve(key)
+	c.metrics.lookup.observe(time.Since(t))
+
+	switch {
+	case err == ErrNotFoundInCache:
+		c.metrics.add(&c.metrics.misses, 1)
+	case err != nil:
+		c.metrics.bypass(BypassLookupError)
+	case res.IsStale():
+		c.metrics.add(&c.metrics.hits, 1)
+		c.metrics.add(&c.metrics.staleHits, 1)
+	default:
+		c.metrics.add(&c.metrics.hits, 1)
+	}
+	return res, err
+}
+
+func (c *InstrumentedCache) Store(res *Resource, keys ...string) error {
+	body, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now()
+	err = c.Cache.Store(copyResource(res, body), keys...)
+	c.metrics.store.observe(time.Since(t))
+
+	if err != nil {
+		c.metrics.add(&c.metrics.storeFailures, 1)
+		return err
+	}
+	c.metrics.add(&c.metrics.stores, 1)
+	c.metrics.add(&c.metrics.storedBytes, int64(len(body)))
+	return nil
+}
+
+func (c *InstrumentedCache) CacheStats() Stats {
+	s := c.metrics.snapshot()
+	if r, ok := c.Cache.(StatsReporter); ok {
+		inner := r.CacheStats()
+		s.Evictions, s.Entries, s.Bytes = inner.Evictions, inner.Entries, inner.Bytes
+	}
+	return s
+}
+
+// CacheStats reports the hits, misses, evictions and size of the cache.
+// Entries removed by the sweeper count as evictions.
+func (b *BoundedCache) CacheStats() Stats {
+	stats := b.Stats()
+	return Stats{
+		Hits:      int64(stats.Hits),
+		Misses:    int64(stats.Misses),
+		Evictions: int64(stats.Evictions + stats.Expired),
+		Entries:   int64(stats.Entries),
+		Bytes:     stats.Bytes,
+		Bypasses:  map[string]int64{},
+	}
+}
@@ -0,0 +1,82 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_CacheStats(t *testing.T) {
+	mw := NewMiddleware(NewBoundedMemoryCache(BoundedOptions{MaxEntries: 1}))
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nostore" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		fmt.Fprint(w, "body")
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "http://example.com/a", nil),
+		httptest.NewRequest("GET", "http://example.com/a", nil),
+		httptest.NewRequest("GET", "http://example.com/nostore", nil),
+		httptest.NewRequest("POST", "http://example.com/a", nil),
+		httptest.NewRequest("GET", "http://example.com/b", nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		Writes.Wait()
+	}
+
+	s := mw.CacheStats()
+	assert.Equal(t, int64(1), s.Hits)
+	assert.Equal(t, int64(3), s.Misses)
+	assert.Equal(t, int64(1), s.Bypasses[BypassRequest])
+	assert.Equal(t, int64(1), s.Bypasses[BypassResponse])
+	// responses to uncacheable requests are still stored under their own key
+	assert.Equal(t, int64(3), s.Stores)
+	assert.Equal(t, int64(12), s.StoredBytes)
+	assert.Equal(t, int64(2), s.Evictions)
+	assert.Equal(t, int64(1), s.Entries)
+	assert.Equal(t, uint64(4), s.LookupLatency.Count)
+	assert.Equal(t, uint64(3), s.StoreLatency.Count)
+	assert.Equal(t, uint64(3), s.StoreLatency.Buckets[latencyBuckets[len(latencyBuckets)-1]])
+}
+
+func TestInstrumentedCache(t *testing.T) {
+	c := NewInstrumentedCache(NewMemoryCache())
+
+	_, err := c.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	storeBytes(t, c, testKey, "body")
+	assert.Equal(t, "body", retrieveBody(t, c, testKey))
+	c.Invalidate(testKey)
+	assert.Equal(t, "body", retrieveBody(t, c, testKey))
+
+	s := c.CacheStats()
+	assert.Equal(t, int64(2), s.Hits)
+	assert.Equal(t, int64(1), s.StaleHits)
+	assert.Equal(t, int64(1), s.Misses)
+	assert.Equal(t, int64(1), s.Stores)
+	assert.Equal(t, int64(4), s.StoredBytes)
+	assert.Equal(t, uint64(3), s.LookupLatency.Count)
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	h.observe(50 * time.Microsecond)
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Minute)
+
+	s := h.snapshot()
+	assert.Equal(t, uint64(3), s.Count)
+	assert.InDelta(t, 60.00205, s.Sum, 1e-9)
+	assert.Equal(t, uint64(1), s.Buckets[.0001])
+	assert.Equal(t, uint64(1), s.Buckets[.001])
+	assert.Equal(t, uint64(2), s.Buckets[.0025])
+	assert.Equal(t, uint64(2), s.Buckets[2.5])
+}
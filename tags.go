@@ -0,0 +1,36 @@
+package negronicache
+
+// TagInvalidator is implemented by caches that can invalidate entries by
+// the tags listed in their Cache-Tag header
+type TagInvalidator interface {
+	InvalidateTags(tags ...string) error
+}
+
+var (
+	_ TagInvalidator = (*cache)(nil)
+	_ TagInvalidator = (*BoundedCache)(nil)
+)
+
+// InvalidateTags invalidates the entries tagged with any of the tags. As
+// the VFS cache keeps no index of the tags, all entries are scanned.
+func (c *cache) InvalidateTags(tags ...string) error {
+	_, err := invalidateWhere(c, func(info EntryInfo) bool {
+		return hasAnyTag(info.Tags, tags)
+	})
+	return err
+}
+
+func (b *BoundedCache) InvalidateTags(tags ...string) error {
+	return b.c.InvalidateTags(tags...)
+}
+
+func hasAnyTag(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
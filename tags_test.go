@@ -0,0 +1,37 @@
+package negronicache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTags_InvalidateTags(t *testing.T) {
+	c := NewMemoryCache()
+	for key, tags := range map[string]string{
+		"GET:http://a.com/1": "catalog, product-1",
+		"GET:http://a.com/2": "catalog product-2",
+		"GET:http://a.com/3": "users",
+	} {
+		h := make(http.Header)
+		h.Set(TagHeader, tags)
+		assert.Nil(t, c.Store(NewResourceBytes(200, []byte(key), h), key))
+	}
+
+	info, err := c.Stat("GET:http://a.com/1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"catalog", "product-1"}, info.Tags)
+
+	assert.Nil(t, c.(TagInvalidator).InvalidateTags("catalog"))
+
+	for key, stale := range map[string]bool{
+		"GET:http://a.com/1": true,
+		"GET:http://a.com/2": true,
+		"GET:http://a.com/3": false,
+	} {
+		res, err := c.Retrieve(key)
+		assert.Nil(t, err)
+		assert.Equal(t, stale, res.IsStale(), key)
+	}
+}
@@ -0,0 +1,217 @@
+package negronicache
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// TieredOptions configures a TieredCache
+type TieredOptions struct {
+	// AsyncL2 stores resources in L2 in the background, tracked by Writes,
+	// rather than before Store returns
+	AsyncL2 bool
+}
+
+// TieredCache combines a small, fast L1 cache with a larger or shared L2
+// cache. Lookups check L1 first and promote L2 hits into L1, while
+// invalidations and revalidations are applied to L2 first so that L1 never
+// holds entries fresher than L2.
+type TieredCache struct {
+	l1, l2 Cache
+	opts   TieredOptions
+	logger *slog.Logger
+
+	// pending tracks the background L2 writes by key, guarded by mu
+	mu      sync.Mutex
+	pending map[string]*l2Writes
+}
+
+// l2Writes counts the background L2 writes of a key, numbering them so that
+// an invalidation or a deletion is applied again after the writes queued
+// before it
+type l2Writes struct {
+	count       int
+	seq         uint64
+	invalidated uint64
+	deleted     uint64
+}
+
+var (
+	_ Cache    = (*TieredCache)(nil)
+	_ Loggable = (*TieredCache)(nil)
+)
+
+// NewTieredCache returns a cache layering l1 over l2
+func NewTieredCache(l1, l2 Cache, opts TieredOptions) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2, opts: opts, pending: map[string]*l2Writes{}}
+}
+
+// SetLogger sets the logger reporting failures to store in either tier. The
+// loggers of the tiers are set separately.
+func (t *TieredCache) SetLogger(l *slog.Logger) {
+	t.logger = l
+}
+
+func (t *TieredCache) Header(key string) (Header, error) {
+	if h, err := t.l1.Header(key); err == nil {
+		return h, nil
+	}
+	return t.l2.Header(key)
+}
+
+func (t *TieredCache) Stat(key string) (EntryInfo, error) {
+	if info, err := t.l1.Stat(key); err == nil {
+		return info, nil
+	}
+	return t.l2.Stat(key)
+}
+
+func (t *TieredCache) Store(res *Resource, keys ...string) error {
+	body, err := readBody(res)
+	if err != nil {
+		return err
+	}
+
+	if err := t.l1.Store(copyResource(res, body), keys...); err != nil {
+		return err
+	}
+
+	if !t.opts.AsyncL2 {
+		return t.l2.Store(copyResource(res, body), keys...)
+	}
+
+	res2 := copyResource(res, body)
+	seqs := t.queue(keys)
+	Writes.Add(1)
+	go func() {
+		defer Writes.Done()
+		if err := t.l2.Store(res2, keys...); err != nil {
+			logError(t.logger, "storing in L2 failed", err, "keys", keys)
+		}
+		invalidated, deleted := t.done(keys, seqs)
+		if len(deleted) > 0 {
+			if err := t.l2.Delete(deleted...); err != nil {
+				logError(t.logger, "deleting from L2 failed", err, "keys", deleted)
+			}
+		}
+		if len(invalidated) > 0 {
+			t.l2.Invalidate(invalidated...)
+		}
+	}()
+	return nil
+}
+
+// queue records a background L2 write of keys, returning its number for
+// each key
+func (t *TieredCache) queue(keys []string) []uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seqs := make([]uint64, len(keys))
+	for i, key := range keys {
+		w := t.pending[key]
+		if w == nil {
+			w = &l2Writes{}
+			t.pending[key] = w
+		}
+		w.count++
+		w.seq++
+		seqs[i] = w.seq
+	}
+	return seqs
+}
+
+// done records the end of a background L2 write, returning the keys
+// invalidated and those deleted while it was queued
+func (t *TieredCache) done(keys []string, seqs []uint64) (invalidated, deleted []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, key := range keys {
+		w := t.pending[key]
+		if seqs[i] <= w.deleted {
+			deleted = append(deleted, key)
+		} else if seqs[i] <= w.invalidated {
+			invalidated = append(invalidated, key)
+		}
+		if w.count--; w.count == 0 {
+			delete(t.pending, key)
+		}
+	}
+	return invalidated, deleted
+}
+
+// Retrieve returns the entry from L1, or from L2 after promoting it into L1
+func (t *TieredCache) Retrieve(key string) (*Resource, error) {
+	if res, err := t.l1.Retrieve(key); err == nil {
+		return res, nil
+	}
+
+	res, err := t.l2.Retrieve(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := readBody(res)
+	res.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.l1.Store(copyResource(res, body), key); err != nil {
+		logError(t.logger, "promoting into L1 failed", err, "key", key)
+	} else if res.IsStale() {
+		t.l1.Invalidate(key)
+	}
+	return copyResource(res, body), nil
+}
+
+// Invalidate invalidates the keys in both tiers. Background L2 writes
+// queued before are invalidated again once stored, so that they don't
+// replace the invalidated entries.
+func (t *TieredCache) Invalidate(keys ...string) {
+	t.mu.Lock()
+	for _, key := range keys {
+		if w := t.pending[key]; w != nil {
+			w.invalidated = w.seq
+		}
+	}
+	t.mu.Unlock()
+
+	t.l2.Invalidate(keys...)
+	t.l1.Invalidate(keys...)
+}
+
+// Delete deletes the keys from both tiers. Background L2 writes queued
+// before are deleted again once stored.
+func (t *TieredCache) Delete(keys ...string) error {
+	t.mu.Lock()
+	for _, key := range keys {
+		if w := t.pending[key]; w != nil {
+			w.deleted = w.seq
+		}
+	}
+	t.mu.Unlock()
+
+	if err := t.l2.Delete(keys...); err != nil {
+		return err
+	}
+	return t.l1.Delete(keys...)
+}
+
+func (t *TieredCache) Freshen(res *Resource, keys ...string) error {
+	if err := t.l2.Freshen(res, keys...); err != nil {
+		// L1 must not outlive a failed revalidation of L2
+		t.l1.Invalidate(keys...)
+		return err
+	}
+	return t.l1.Freshen(res, keys...)
+}
+
+// copyResource returns a copy of a resource holding body
+func copyResource(res *Resource, body []byte) *Resource {
+	c := NewResourceBytes(res.Status(), body, cloneHeader(res.Header()))
+	c.RequestTime = res.RequestTime
+	c.ResponseTime = res.ResponseTime
+	if res.IsStale() {
+		c.MarkStale()
+	}
+	return c
+}
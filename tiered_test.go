@@ -0,0 +1,146 @@
+package negronicache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func retrieveBody(t *testing.T, c Cache, key string) string {
+	res, err := c.Retrieve(key)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	b, _ := ioutil.ReadAll(res)
+	return string(b)
+}
+
+func TestTieredCache_Store(t *testing.T) {
+	l1, l2 := NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(l1, l2, TieredOptions{})
+
+	storeBytes(t, c, testKey, "body")
+	assert.Equal(t, "body", retrieveBody(t, l1, testKey))
+	assert.Equal(t, "body", retrieveBody(t, l2, testKey))
+	assert.Equal(t, "body", retrieveBody(t, c, testKey))
+}
+
+func TestTieredCache_AsyncL2(t *testing.T) {
+	l1, l2 := NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(l1, l2, TieredOptions{AsyncL2: true})
+
+	storeBytes(t, c, testKey, "body")
+	Writes.Wait()
+	assert.Equal(t, "body", retrieveBody(t, l2, testKey))
+}
+
+// slowStoreCache delays stores until release is closed
+type slowStoreCache struct {
+	Cache
+	release chan struct{}
+}
+
+func (c *slowStoreCache) Store(res *Resource, keys ...string) error {
+	<-c.release
+	return c.Cache.Store(res, keys...)
+}
+
+func TestTieredCache_AsyncL2Invalidate(t *testing.T) {
+	l2 := &slowStoreCache{Cache: NewMemoryCache(), release: make(chan struct{})}
+	c := NewTieredCache(NewMemoryCache(), l2, TieredOptions{AsyncL2: true})
+
+	storeBytes(t, c, testKey, "body")
+	c.Invalidate(testKey)
+	close(l2.release)
+	Writes.Wait()
+
+	res, err := l2.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+	assert.Empty(t, c.pending)
+
+	// a store queued after the invalidation isn't invalidated
+	storeBytes(t, c, testKey, "body")
+	Writes.Wait()
+	res, err = l2.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.False(t, res.IsStale())
+}
+
+func TestTieredCache_AsyncL2Delete(t *testing.T) {
+	l2 := &slowStoreCache{Cache: NewMemoryCache(), release: make(chan struct{})}
+	c := NewTieredCache(NewMemoryCache(), l2, TieredOptions{AsyncL2: true})
+
+	storeBytes(t, c, testKey, "body")
+	assert.Nil(t, c.Delete(testKey))
+	close(l2.release)
+	Writes.Wait()
+
+	_, err := c.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	_, err = l2.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+	assert.Empty(t, c.pending)
+
+	// a store queued after the deletion is kept
+	storeBytes(t, c, testKey, "body")
+	Writes.Wait()
+	assert.Equal(t, "body", retrieveBody(t, l2, testKey))
+}
+
+func TestTieredCache_Promote(t *testing.T) {
+	l1, l2 := NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(l1, l2, TieredOptions{})
+
+	storeBytes(t, l2, testKey, "body")
+	l2.Invalidate(testKey)
+	_, err := l1.Retrieve(testKey)
+	assert.Equal(t, ErrNotFoundInCache, err)
+
+	res, err := c.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+	b, _ := ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+
+	res, err = l1.Retrieve(testKey)
+	assert.Nil(t, err)
+	assert.True(t, res.IsStale())
+	b, _ = ioutil.ReadAll(res)
+	assert.Equal(t, "body", string(b))
+}
+
+func TestTieredCache_InvalidateFreshen(t *testing.T) {
+	l1, l2 := NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(l1, l2, TieredOptions{})
+
+	h := make(http.Header)
+	h.Set("ETag", `"v1"`)
+	assert.Nil(t, c.Store(NewResourceBytes(200, []byte("body"), h), testKey))
+
+	c.Invalidate(testKey)
+	for _, tier := range []Cache{l1, l2} {
+		res, err := tier.Retrieve(testKey)
+		assert.Nil(t, err)
+		assert.True(t, res.IsStale())
+	}
+
+	h = make(http.Header)
+	h.Set("ETag", `"v1"`)
+	h.Set("X-Validated", "yes")
+	assert.Nil(t, c.Freshen(NewResourceBytes(200, nil, h), testKey))
+	for _, tier := range []Cache{l1, l2} {
+		res, err := tier.Retrieve(testKey)
+		assert.Nil(t, err)
+		assert.False(t, res.IsStale())
+		assert.Equal(t, "yes", res.Header().Get("X-Validated"))
+	}
+
+	assert.Nil(t, c.Delete(testKey))
+	for _, tier := range []Cache{l1, l2, c} {
+		_, err := tier.Retrieve(testKey)
+		assert.Equal(t, ErrNotFoundInCache, err)
+	}
+}
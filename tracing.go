@@ -0,0 +1,49 @@
+package negronicache
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of the package
+const tracerName = "github.com/trumanw/negroni-cache"
+
+// Span attributes
+const (
+	attrKeyHash   = attribute.Key("cache.key_hash")
+	attrResult    = attribute.Key("cache.result")
+	attrHit       = attribute.Key("cache.hit")
+	attrFreshness = attribute.Key("cache.freshness_seconds")
+	attrBytes     = attribute.Key("cache.bytes")
+	attrValidated = attribute.Key("cache.validated")
+	attrStatus    = attribute.Key("http.status_code")
+)
+
+func (ch *Middleware) tracer() trace.Tracer {
+	tp := ch.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func keyHash(key string) attribute.KeyValue {
+	return attrKeyHash.String(hashKey(key))
+}
+
+// recordError marks a span as failed
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// detachedContext carries the span of ctx into parent without the
+// cancellation of ctx, for work outliving the request such as background
+// stores
+func detachedContext(parent, ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(parent, trace.SpanContextFromContext(ctx))
+}
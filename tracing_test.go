@@ -0,0 +1,91 @@
+package negronicache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func spansByName(rec *tracetest.SpanRecorder) map[string][]sdktrace.ReadOnlySpan {
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range rec.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	return spans
+}
+
+func TestMiddleware_Tracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	mw := NewMiddleware(NewMemoryCache())
+	mw.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "body")
+	}))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/traced", nil))
+		Writes.Wait()
+	}
+
+	spans := spansByName(rec)
+	assert.Len(t, spans["negronicache.ServeHTTP"], 2)
+	assert.Len(t, spans["negronicache.lookup"], 2)
+	assert.Len(t, spans["negronicache.upstream"], 1)
+	assert.Len(t, spans["negronicache.store"], 1)
+
+	miss, hit := spans["negronicache.ServeHTTP"][0], spans["negronicache.ServeHTTP"][1]
+	assert.Equal(t, "miss", spanAttrs(miss)[attrResult].AsString())
+	assert.Equal(t, "hit", spanAttrs(hit)[attrResult].AsString())
+	assert.Equal(t, hashKey("GET:http://example.com/traced"), spanAttrs(hit)[attrKeyHash].AsString())
+
+	lookup := spans["negronicache.lookup"][1]
+	assert.True(t, spanAttrs(lookup)[attrHit].AsBool())
+	assert.True(t, spanAttrs(lookup)[attrFreshness].AsFloat64() > 0)
+	assert.Equal(t, hit.SpanContext().SpanID(), lookup.Parent().SpanID())
+
+	upstream := spans["negronicache.upstream"][0]
+	assert.Equal(t, int64(4), spanAttrs(upstream)[attrBytes].AsInt64())
+	assert.Equal(t, miss.SpanContext().SpanID(), upstream.Parent().SpanID())
+
+	// the background store belongs to the trace of the request
+	store := spans["negronicache.store"][0]
+	assert.Equal(t, miss.SpanContext().TraceID(), store.SpanContext().TraceID())
+	assert.Equal(t, int64(4), spanAttrs(store)[attrBytes].AsInt64())
+}
+
+type failingCache struct {
+	Cache
+	err error
+}
+
+func (c failingCache) Retrieve(key string) (*Resource, error) { return nil, c.err }
+
+func TestMiddleware_TracingError(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	mw := NewMiddleware(failingCache{NewMemoryCache(), errors.New("disk failure")})
+	mw.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	mw.Handler(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest("GET", "http://example.com/traced", nil))
+
+	lookup := spansByName(rec)["negronicache.lookup"][0]
+	assert.Equal(t, codes.Error, lookup.Status().Code)
+	assert.Equal(t, "disk failure", lookup.Status().Description)
+}
@@ -0,0 +1,235 @@
+package negronicache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+)
+
+// Transport is an http.RoundTripper that serves responses from a Cache and
+// stores cacheable upstream responses in it, applying the same freshness and
+// validation rules as the Middleware
+type Transport struct {
+	// Transport is used to make upstream requests, http.DefaultTransport if nil
+	Transport http.RoundTripper
+	Shared    bool
+	// Logger receives the records of the transport, the package Logger if
+	// nil
+	Logger *slog.Logger
+	cache  Cache
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// NewTransport returns a private caching Transport backed by the given cache
+func NewTransport(cache Cache) *Transport {
+	return &Transport{
+		cache:  cache,
+		Shared: false,
+	}
+}
+
+// Client returns an *http.Client that uses the Transport
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport != nil {
+		return t.Transport
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip serves the request from the cache when a fresh response exists,
+// revalidates stale responses that carry validators and otherwise forwards
+// the request upstream, storing the response if it is cacheable
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cReq, err := NewCacheRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cReq.isCacheable() {
+		t.logDecision(cReq, "skip", "reason", BypassRequest)
+		resp, err := t.transport().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Set(CacheHeader, "SKIP")
+		return resp, nil
+	}
+
+	res, err := lookup(req.Context(), AsContextCache(t.cache), cReq)
+	if err != nil && err != ErrNotFoundInCache {
+		logError(t.Logger, "lookup failed", err, "key", cReq.Key.String())
+	}
+
+	if err != nil {
+		if cReq.CacheControl.Has("only-if-cached") {
+			return errorResponse(req, http.StatusGatewayTimeout, "key not in cache"), nil
+		}
+		t.logDecision(cReq, "miss")
+		return t.fetch(cReq)
+	}
+
+	if fresh, err := freshness(res, cReq, t.Shared); (err == nil && fresh > 0) ||
+		cReq.CacheControl.Has("only-if-cached") {
+		t.logDecision(cReq, "hit", "status", res.Status())
+		return t.cachedResponse(res, cReq)
+	}
+
+	if res.HasValidators() {
+		return t.revalidate(res, cReq)
+	}
+
+	res.Close()
+	return t.fetch(cReq)
+}
+
+// revalidate sends a conditional request for a stale resource, serving the
+// cached body if upstream responds with 304 Not Modified
+func (t *Transport) revalidate(res *Resource, r *CacheRequest) (*http.Response, error) {
+	outreq := cloneRequest(r.Request)
+	if etag := res.Header().Get("ETag"); etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastMod := res.Header().Get("Last-Modified"); lastMod != "" {
+		outreq.Header.Set("If-Modified-Since", lastMod)
+	}
+
+	t.logDecision(r, "revalidate")
+	resp, err := t.transport().RoundTrip(outreq)
+	if err != nil {
+		res.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusNotModified {
+		res.Close()
+		return t.store(resp, r)
+	}
+	resp.Body.Close()
+
+	for key, headers := range resp.Header {
+		res.Header()[key] = headers
+	}
+	res.Header().Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	if err := t.cache.Freshen(res, storeKeys(res, r)...); err != nil {
+		logError(t.Logger, "freshening failed", err, "key", r.Key.String())
+	}
+
+	return t.cachedResponse(res, r)
+}
+
+// fetch forwards the request upstream and stores the response if cacheable
+func (t *Transport) fetch(r *CacheRequest) (*http.Response, error) {
+	resp, err := t.transport().RoundTrip(r.Request)
+	if err != nil {
+		return nil, err
+	}
+	return t.store(resp, r)
+}
+
+func (t *Transport) store(resp *http.Response, r *CacheRequest) (*http.Response, error) {
+	resp.Header.Set(CacheHeader, "SKIP")
+
+	res := NewResourceBytes(resp.StatusCode, nil, resp.Header)
+	if !isCacheableResource(res, r, t.Shared) {
+		t.logDecision(r, "skip", "reason", BypassResponse, "status", resp.StatusCode)
+		return resp, nil
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	h := cloneHeader(resp.Header)
+	h.Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	res = NewResourceBytes(resp.StatusCode, b, h)
+	res.RequestTime = r.Time
+	res.ResponseTime = Clock()
+
+	if t.Shared {
+		res.RemovePrivateHeaders()
+	}
+
+	keys := storeKeys(res, r)
+	if err := t.cache.Store(res, keys...); err != nil {
+		logError(t.Logger, "storing failed", err, "keys", keys)
+	}
+
+	return resp, nil
+}
+
+// logDecision logs how the transport handled a request
+func (t *Transport) logDecision(r *CacheRequest, decision string, args ...any) {
+	logDebug(t.Logger, "cache decision", append([]any{
+		"method", r.Method,
+		"key", r.Key.String(),
+		"decision", decision,
+		"shared", t.Shared,
+	}, args...)...)
+}
+
+// cachedResponse builds an *http.Response out of a cached Resource
+func (t *Transport) cachedResponse(res *Resource, r *CacheRequest) (*http.Response, error) {
+	defer res.Close()
+
+	h := cloneHeader(res.Header())
+	h.Set(CacheHeader, "HIT")
+	if err := setCachedHeaders(h, res, r, t.Shared); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if r.Method != "HEAD" {
+		var err error
+		if b, err = ioutil.ReadAll(res); err != nil {
+			return nil, err
+		}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", res.Status(), http.StatusText(res.Status())),
+		StatusCode:    res.Status(),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       r.Request,
+	}, nil
+}
+
+func errorResponse(req *http.Request, code int, msg string) *http.Response {
+	h := make(http.Header)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set(CacheHeader, "SKIP")
+	body := msg + "\n"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, s := range h {
+		h2[k] = append([]string(nil), s...)
+	}
+	return h2
+}
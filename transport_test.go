@@ -0,0 +1,79 @@
+package negronicache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransport_RoundTrip(t *testing.T) {
+	upstream := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "response %d", upstream)
+	}))
+	defer ts.Close()
+
+	client := NewTransport(NewMemoryCache()).Client()
+
+	resp, err := client.Get(ts.URL + "/fresh")
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "SKIP", resp.Header.Get(CacheHeader))
+	assert.Equal(t, "response 1", string(b))
+
+	resp, err = client.Get(ts.URL + "/fresh")
+	assert.Nil(t, err)
+	b, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "HIT", resp.Header.Get(CacheHeader))
+	assert.Equal(t, "response 1", string(b))
+	assert.Equal(t, 1, upstream)
+}
+
+func TestTransport_Revalidate(t *testing.T) {
+	upstream, notModified := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream++
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "validated body")
+	}))
+	defer ts.Close()
+
+	client := NewTransport(NewMemoryCache()).Client()
+
+	resp, err := client.Get(ts.URL + "/validate")
+	assert.Nil(t, err)
+	ioutil.ReadAll(resp.Body)
+
+	resp, err = client.Get(ts.URL + "/validate")
+	assert.Nil(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "HIT", resp.Header.Get(CacheHeader))
+	assert.Equal(t, "validated body", string(b))
+	assert.Equal(t, 2, upstream)
+	assert.Equal(t, 1, notModified)
+}
+
+func TestTransport_OnlyIfCached(t *testing.T) {
+	tr := NewTransport(NewMemoryCache())
+
+	req, err := http.NewRequest("GET", "http://example.com/missing", nil)
+	assert.Nil(t, err)
+	req.Header.Set("Cache-Control", "only-if-cached")
+
+	resp, err := tr.RoundTrip(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+}
@@ -0,0 +1,131 @@
+package negronicache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TTLHeader records the freshness lifetime in seconds of a stored response,
+// as set by the TTL settings of the Middleware. It takes precedence over the
+// Cache-Control and Expires headers and is never sent to clients.
+const TTLHeader = "X-Negronicache-Ttl"
+
+// TTLRule bounds the freshness lifetime of the responses to requests whose
+// path starts with Prefix, zero meaning no bound
+type TTLRule struct {
+	Prefix   string
+	Min, Max time.Duration
+}
+
+// ttlBounds returns the bounds of the freshness lifetime of the response to
+// a request, those of the longest matching rule if any
+func (ch *Middleware) ttlBounds(r *http.Request) (min, max time.Duration) {
+	min, max = ch.MinTTL, ch.MaxTTL
+	matched := -1
+	for _, rule := range ch.TTLRules {
+		if strings.HasPrefix(r.URL.Path, rule.Prefix) && len(rule.Prefix) > matched {
+			min, max, matched = rule.Min, rule.Max, len(rule.Prefix)
+		}
+	}
+	return min, max
+}
+
+// overrideTTL parses the TTLOverrideHeader of a response, either a number
+// of seconds or a unix time prefixed with @
+func (ch *Middleware) overrideTTL(res *Resource) (time.Duration, bool) {
+	if ch.TTLOverrideHeader == "" {
+		return 0, false
+	}
+	value := strings.TrimSpace(res.Header().Get(ch.TTLOverrideHeader))
+	if value == "" {
+		return 0, false
+	}
+
+	if strings.HasPrefix(value, "@") {
+		unix, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		date, err := timeHeader("Date", res.Header())
+		if err != nil {
+			date = Clock()
+		}
+		if ttl := time.Unix(unix, 0).Sub(date); ttl > 0 {
+			return ttl, true
+		}
+		return 0, true
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// applyTTL sets the TTLHeader of a response about to be stored, if its
+// lifetime is overridden by the TTLOverrideHeader, bounded by the TTL
+// settings or shortened by the TTLJitter. The TTLOverrideHeader itself isn't
+// stored.
+func (ch *Middleware) applyTTL(res *Resource, r *CacheRequest) {
+	res.Header().Del(TTLHeader)
+	lifetime, overridden := ch.overrideTTL(res)
+	if ch.TTLOverrideHeader != "" {
+		res.Header().Del(ch.TTLOverrideHeader)
+	}
+
+	if !overridden {
+		maxAge, err := res.MaxAge(ch.Shared)
+		if err != nil {
+			return
+		}
+		if hFresh := res.HeuristicFreshness(); hFresh > maxAge {
+			maxAge = hFresh
+		}
+		lifetime = maxAge
+	}
+
+	ttl := lifetime
+	min, max := ch.ttlBounds(r.Request)
+	if min > 0 && ttl < min {
+		ttl = min
+	}
+	if max > 0 && ttl > max {
+		ttl = max
+	}
+	ttl -= ch.jitter(ttl, r)
+
+	if overridden || ttl != lifetime {
+		res.Header().Set(TTLHeader, strconv.FormatInt(int64(ttl/time.Second), 10))
+	}
+}
+
+// ttlWriter removes the TTLOverrideHeader of an upstream response before
+// its headers are written, keeping its value for storing the response
+type ttlWriter struct {
+	http.ResponseWriter
+	header      string
+	value       string
+	wroteHeader bool
+}
+
+func (w *ttlWriter) strip() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.value = w.Header().Get(w.header)
+	w.Header().Del(w.header)
+}
+
+func (w *ttlWriter) WriteHeader(status int) {
+	w.strip()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *ttlWriter) Write(b []byte) (int, error) {
+	w.strip()
+	return w.ResponseWriter.Write(b)
+}
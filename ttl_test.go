@@ -0,0 +1,84 @@
+package negronicache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware_ApplyTTL(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	mw.MaxTTL = 24 * time.Hour
+	mw.TTLRules = []TTLRule{{Prefix: "/api/", Min: 5 * time.Second}, {Prefix: "/api/slow/", Max: time.Minute}}
+	mw.TTLOverrideHeader = "X-Accel-Expires"
+	date := Clock().Truncate(time.Second)
+
+	for _, tc := range []struct {
+		path, cacheControl, override, ttl string
+	}{
+		{"/page", "max-age=31536000", "", "86400"},
+		{"/page", "max-age=60", "", ""},
+		{"/api/list", "max-age=0", "", "5"},
+		{"/api/slow/report", "max-age=3600", "", "60"},
+		{"/page", "max-age=60", "600", "600"},
+		{"/page", "max-age=60", "172800", "86400"},
+		{"/page", "max-age=60", fmt.Sprintf("@%d", date.Add(time.Hour).Unix()), "3600"},
+	} {
+		h := http.Header{"Cache-Control": {tc.cacheControl}, "Date": {date.Format(http.TimeFormat)}}
+		if tc.override != "" {
+			h.Set("X-Accel-Expires", tc.override)
+		}
+		res := NewResourceBytes(200, nil, h)
+		r, _ := NewCacheRequest(httptest.NewRequest("GET", "http://example.com"+tc.path, nil))
+
+		mw.applyTTL(res, r)
+		assert.Equal(t, tc.ttl, res.Header().Get(TTLHeader), tc.path+" "+tc.cacheControl+" "+tc.override)
+		assert.Empty(t, res.Header().Get("X-Accel-Expires"))
+		if tc.ttl != "" {
+			seconds, _ := strconv.Atoi(tc.ttl)
+			maxAge, _ := res.MaxAge(false)
+			assert.Equal(t, time.Duration(seconds)*time.Second, maxAge)
+		}
+	}
+}
+
+func TestMiddleware_TTLOverride(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	mw.Shared = true
+	mw.MinTTL = 5 * time.Second
+	mw.TTLOverrideHeader = "X-Accel-Expires"
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.URL.Path == "/never" {
+			w.Header().Set("X-Accel-Expires", "0")
+		} else {
+			w.Header().Set("X-Accel-Expires", "120")
+		}
+		fmt.Fprint(w, "body")
+	}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		Writes.Wait()
+		return rec
+	}
+
+	rec := get("/a")
+	assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+	assert.Empty(t, rec.Header().Get("X-Accel-Expires"))
+
+	rec = get("/a")
+	assert.Equal(t, "HIT", rec.Header().Get(CacheHeader))
+	assert.Equal(t, "max-age=0", rec.Header().Get("Cache-Control"))
+	assert.Empty(t, rec.Header().Get("X-Accel-Expires"))
+	assert.Empty(t, rec.Header().Get(TTLHeader))
+
+	get("/never")
+	assert.Equal(t, "SKIP", get("/never").Header().Get(CacheHeader))
+}
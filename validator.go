@@ -10,7 +10,17 @@ type Validator struct {
 	Handler http.Handler
 }
 
+// Validate revalidates res against the handler, and reports whether the
+// handler responded 304 Not Modified, in which case the headers of the 304
+// are merged into those of res
 func (v *Validator) Validate(req *http.Request, res *Resource) bool {
+	validated, _ := v.validate(req, res)
+	return validated
+}
+
+// validate is Validate, also returning the response of the handler when
+// it isn't a 304
+func (v *Validator) validate(req *http.Request, res *Resource) (bool, *httptest.ResponseRecorder) {
 	outreq := cloneRequest(req)
 	resHeaders := res.Header()
 
@@ -25,17 +35,23 @@ func (v *Validator) Validate(req *http.Request, res *Resource) bool {
 	v.Handler.ServeHTTP(resp, outreq)
 	resp.Flush()
 
-	if age, err := CorrectedAge(resp.HeaderMap, t, Clock()); err == nil {
-		resp.Header().Set("Age", fmt.Sprintf("%.f", age.Seconds()))
+	if resp.Code != http.StatusNotModified || !headersEqual(resHeaders, resp.Header()) {
+		return false, resp
 	}
 
-	if headersEqual(resHeaders, resp.HeaderMap) {
-		res.header = resp.HeaderMap
-		res.header.Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
-		return true
+	if age, err := CorrectedAge(resp.Header(), t, Clock()); err == nil {
+		resp.Header().Set("Age", fmt.Sprintf("%.f", age.Seconds()))
 	}
 
-	return false
+	// the 304 only updates the stored headers it carries
+	header := cloneHeader(resHeaders)
+	for key, values := range resp.Header() {
+		header[key] = values
+	}
+	header.Set(ProxyDateHeader, Clock().Format(http.TimeFormat))
+	res.header = header
+	res.cc = nil
+	return true, nil
 }
 
 var validationHeaders = []string{"ETag", "Content-MD5", "Last-Modified", "Content-Length"}
@@ -44,7 +60,7 @@ func headersEqual(h1, h2 http.Header) bool {
 	for _, header := range validationHeaders {
 		if value := h2.Get(header); value != "" {
 			if h1.Get(header) != value {
-				debugf("%s changed, %q != %q", header, value, h1.Get(header))
+				logDebug(nil, "validator changed", "header", header, "stored", h1.Get(header), "upstream", value)
 				return false
 			}
 		}
@@ -0,0 +1,178 @@
+package negronicache
+
+import (
+	"context"
+	"sync"
+)
+
+// DropPolicy selects which write is dropped when the write queue of a
+// Middleware is full
+type DropPolicy int
+
+const (
+	// DropNewest drops the write being queued
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest queued write to make room
+	DropOldest
+	// Block waits for room in the queue, delaying the end of the request
+	Block
+)
+
+const (
+	defaultWriteWorkers = 4
+	defaultWriteQueue   = 64
+)
+
+// write is a resource waiting to be stored
+type write struct {
+	res *Resource
+	r   *CacheRequest
+	key string
+}
+
+// writeQueue stores resources in the background with a bounded number of
+// workers and of queued writes. Writes for a key which is already queued or
+// being stored are dropped.
+type writeQueue struct {
+	store   func(ctx context.Context, w *write)
+	metrics *metrics
+	size    int
+	policy  DropPolicy
+
+	mu sync.Mutex
+	// cond is signalled when the pending writes change or the queue closes
+	cond    *sync.Cond
+	pending []*write
+	// keys holds the keys of the queued and running writes
+	keys   map[string]bool
+	closed bool
+
+	// ctx is cancelled when closing the queue times out
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+func newWriteQueue(workers, size int, policy DropPolicy, m *metrics, store func(context.Context, *write)) *writeQueue {
+	if workers <= 0 {
+		workers = defaultWriteWorkers
+	}
+	if size <= 0 {
+		size = defaultWriteQueue
+	}
+
+	q := &writeQueue{
+		store:   store,
+		metrics: m,
+		size:    size,
+		policy:  policy,
+		keys:    map[string]bool{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// push queues a write, and reports whether it was accepted
+func (q *writeQueue) push(w *write) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.keys[w.key] {
+		return false
+	}
+
+	for len(q.pending) >= q.size {
+		switch q.policy {
+		case DropOldest:
+			q.drop(q.pending[0])
+			q.pending = q.pending[1:]
+		case Block:
+			q.cond.Wait()
+			if q.closed || q.keys[w.key] {
+				return false
+			}
+		default:
+			q.metrics.add(&q.metrics.droppedWrites, 1)
+			return false
+		}
+	}
+
+	Writes.Add(1)
+	q.keys[w.key] = true
+	q.pending = append(q.pending, w)
+	q.cond.Broadcast()
+	return true
+}
+
+// drop discards a queued write, the lock being held
+func (q *writeQueue) drop(w *write) {
+	delete(q.keys, w.key)
+	q.metrics.add(&q.metrics.droppedWrites, 1)
+	Writes.Done()
+}
+
+func (q *writeQueue) work() {
+	defer q.workers.Done()
+
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		w := q.pending[0]
+		q.pending = q.pending[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		q.store(detachedContext(q.ctx, w.r.Context()), w)
+
+		q.mu.Lock()
+		delete(q.keys, w.key)
+		q.mu.Unlock()
+		Writes.Done()
+	}
+}
+
+// close stops accepting writes and waits for the pending ones. Once ctx is
+// done, the queued writes are dropped and the running ones cancelled.
+func (q *writeQueue) close(ctx context.Context) error {
+	defer q.cancel()
+
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for _, w := range q.pending {
+		q.drop(w)
+	}
+	q.pending = nil
+	q.mu.Unlock()
+	q.cancel()
+
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,130 @@
+package negronicache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingQueue returns a queue with a single worker whose stores wait for
+// release, or for the cancellation of their context
+func blockingQueue(size int, policy DropPolicy) (*writeQueue, *metrics, chan struct{}, *[]string) {
+	m := &metrics{}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var stored []string
+	q := newWriteQueue(1, size, policy, m, func(ctx context.Context, w *write) {
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return
+		}
+		mu.Lock()
+		stored = append(stored, w.key)
+		mu.Unlock()
+	})
+	return q, m, release, &stored
+}
+
+func queuedWrite(key string) *write {
+	return &write{r: &CacheRequest{Request: httptest.NewRequest("GET", "http://example.com/", nil)}, key: key}
+}
+
+// waitRunning waits until the worker took the only queued write
+func waitRunning(q *writeQueue) {
+	for {
+		q.mu.Lock()
+		n := len(q.pending)
+		q.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWriteQueue_DropNewest(t *testing.T) {
+	q, m, release, stored := blockingQueue(1, DropNewest)
+	assert.True(t, q.push(queuedWrite("a")))
+	waitRunning(q)
+	assert.False(t, q.push(queuedWrite("a")), "already running")
+	assert.True(t, q.push(queuedWrite("b")))
+	assert.False(t, q.push(queuedWrite("b")), "already queued")
+	assert.False(t, q.push(queuedWrite("c")))
+	assert.Equal(t, int64(1), m.snapshot().DroppedWrites)
+
+	close(release)
+	assert.Nil(t, q.close(context.Background()))
+	assert.Equal(t, []string{"a", "b"}, *stored)
+	assert.False(t, q.push(queuedWrite("d")))
+}
+
+func TestWriteQueue_DropOldest(t *testing.T) {
+	q, m, release, stored := blockingQueue(1, DropOldest)
+	q.push(queuedWrite("a"))
+	waitRunning(q)
+	q.push(queuedWrite("b"))
+	q.push(queuedWrite("c"))
+	assert.Equal(t, int64(1), m.snapshot().DroppedWrites)
+
+	close(release)
+	assert.Nil(t, q.close(context.Background()))
+	assert.Equal(t, []string{"a", "c"}, *stored)
+}
+
+func TestWriteQueue_Block(t *testing.T) {
+	q, _, release, stored := blockingQueue(1, Block)
+	q.push(queuedWrite("a"))
+	waitRunning(q)
+	q.push(queuedWrite("b"))
+
+	pushed := make(chan bool)
+	go func() { pushed <- q.push(queuedWrite("c")) }()
+	select {
+	case <-pushed:
+		t.Fatal("push didn't block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	assert.True(t, <-pushed)
+	assert.Nil(t, q.close(context.Background()))
+	assert.Equal(t, []string{"a", "b", "c"}, *stored)
+}
+
+func TestWriteQueue_CloseTimeout(t *testing.T) {
+	q, m, _, stored := blockingQueue(2, DropNewest)
+	q.push(queuedWrite("a"))
+	waitRunning(q)
+	q.push(queuedWrite("b"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, q.close(ctx))
+	assert.Empty(t, *stored)
+	assert.Equal(t, int64(1), m.snapshot().DroppedWrites)
+}
+
+func TestMiddleware_Close(t *testing.T) {
+	mw := NewMiddleware(NewMemoryCache())
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "body")
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/a", nil))
+	assert.Nil(t, mw.Close(context.Background()))
+	assert.Equal(t, int64(1), mw.CacheStats().Stores)
+
+	// responses aren't stored once closed
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com/b", nil))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "http://example.com/b", nil))
+	assert.Equal(t, "SKIP", rec.Header().Get(CacheHeader))
+}